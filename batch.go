@@ -0,0 +1,45 @@
+package fastagent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// handleBatch runs each sub-request through dispatch, so every handler is
+// batchable without knowing it. The sub-requests share the batch's
+// context: cancelling the batch cancels whichever one is running and skips
+// the rest.
+func (s *Server) handleBatch(ctx context.Context, params json.RawMessage) (any, error) {
+	var p BatchParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, invalidParams("unmarshal BatchParams: %w", err)
+	}
+	for i, req := range p.Requests {
+		switch req.Method {
+		case "Hello", "Batch":
+			// Hello can switch the connection's wire format, which only
+			// works between messages, and nesting buys nothing.
+			return nil, unsupported("requests", "batch: request %d: %s cannot be batched", i, req.Method)
+		}
+	}
+
+	// Sub-requests get a call without the batch's payload, so a batched
+	// WriteFile doesn't mistake it for its own content.
+	if c := callFromContext(ctx); c != nil {
+		ctx = context.WithValue(ctx, callKey{}, &call{id: c.id, sess: c.sess, cancel: c.cancel})
+	}
+
+	results := make([]Response, 0, len(p.Requests))
+	for _, req := range p.Requests {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("batch: %w", err)
+		}
+		resp := s.dispatch(ctx, req)
+		results = append(results, resp)
+		if resp.Error != nil && p.StopOnError {
+			break
+		}
+	}
+	return BatchResult{Results: results}, nil
+}
@@ -0,0 +1,80 @@
+package fastagent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBatchContinue(t *testing.T) {
+	s := newTestServer()
+	dir := t.TempDir()
+	resp := rpcCall(t, s, "Batch", BatchParams{
+		Requests: []Request{
+			{ID: 10, Method: "File", Params: rawParams(t, FileParams{Path: filepath.Join(dir, "a"), State: "directory"})},
+			{ID: 11, Method: "Stat", Params: rawParams(t, StatParams{Path: filepath.Join(dir, "a")})},
+			{ID: 12, Method: "Bogus"},
+			{ID: 13, Method: "File", Params: rawParams(t, FileParams{Path: filepath.Join(dir, "b"), State: "directory"})},
+		},
+	})
+	var result BatchResult
+	decodeResult(t, resp, &result)
+
+	if len(result.Results) != 4 {
+		t.Fatalf("got %d results, want 4", len(result.Results))
+	}
+	for i, r := range result.Results {
+		if want := int64(10 + i); r.ID != want {
+			t.Errorf("result %d has id %d, want %d", i, r.ID, want)
+		}
+	}
+	if result.Results[0].Error != nil || result.Results[1].Error != nil || result.Results[3].Error != nil {
+		t.Errorf("unexpected errors: %+v", result.Results)
+	}
+	if result.Results[2].Error == nil || result.Results[2].Error.Code != -32601 {
+		t.Errorf("unknown method result = %+v, want -32601", result.Results[2])
+	}
+	var st StatResult
+	decodeResult(t, result.Results[1], &st)
+	if !st.Exists || !st.IsDir {
+		t.Errorf("stat after mkdir in the same batch = %+v", st)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b")); err != nil {
+		t.Errorf("request after the failure didn't run: %v", err)
+	}
+}
+
+func TestBatchStopOnError(t *testing.T) {
+	s := newTestServer()
+	dir := t.TempDir()
+	resp := rpcCall(t, s, "Batch", BatchParams{
+		StopOnError: true,
+		Requests: []Request{
+			{ID: 1, Method: "Exec", Params: rawParams(t, map[string]any{"argv": []string{"true"}})},
+			{ID: 2, Method: "ReadFile", Params: rawParams(t, ReadFileParams{Path: filepath.Join(dir, "missing")})},
+			{ID: 3, Method: "File", Params: rawParams(t, FileParams{Path: filepath.Join(dir, "never"), State: "directory"})},
+		},
+	})
+	var result BatchResult
+	decodeResult(t, resp, &result)
+
+	if len(result.Results) != 2 {
+		t.Fatalf("got %d results, want 2", len(result.Results))
+	}
+	if result.Results[1].Error == nil {
+		t.Error("ReadFile of a missing file succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "never")); !os.IsNotExist(err) {
+		t.Errorf("request after the failure ran (stat err %v)", err)
+	}
+}
+
+func TestBatchRejectsHello(t *testing.T) {
+	s := newTestServer()
+	resp := rpcCall(t, s, "Batch", BatchParams{
+		Requests: []Request{{ID: 1, Method: "Hello", Params: rawParams(t, HelloParams{Version: "test"})}},
+	})
+	if resp.Error == nil {
+		t.Fatal("expected an error for a batched Hello")
+	}
+}
@@ -19,11 +19,15 @@ import (
 )
 
 func main() {
+	// Privilege-dropped helpers are this same binary, re-executed.
+	fastagent.HelperMain()
+
 	serve := flag.Bool("serve", false, "serve on stdin/stdout (one-shot)")
 	daemon := flag.Bool("daemon", false, "start persistent daemon on a Unix socket")
 	connect := flag.Bool("connect", false, "bridge stdin/stdout to a running daemon")
 	socket := flag.String("socket", "", "Unix socket path (for --daemon and --connect)")
 	allowUser := flag.String("allow-user", "", "grant this user access to the daemon socket (for --daemon)")
+	jobDir := flag.String("job-dir", "", "directory for background job results (default ~/.ansible_async)")
 	idleTimeout := flag.Duration("idle-timeout", fastagent.DefaultIdleTimeout, "daemon auto-shutdown after this idle duration")
 	version := flag.Bool("version", false, "print version and exit")
 	debug := flag.Bool("debug", false, "enable debug logging to stderr")
@@ -50,7 +54,7 @@ func main() {
 
 	switch {
 	case *serve:
-		s := &fastagent.Server{Logger: logger}
+		s := &fastagent.Server{Logger: logger, JobDir: *jobDir}
 		if err := s.Serve(os.Stdin, os.Stdout); err != nil {
 			logger.Error("serve failed", "error", err)
 			os.Exit(1)
@@ -61,7 +65,7 @@ func main() {
 		if socketPath == "" {
 			socketPath = fmt.Sprintf("/tmp/fastagent-%d.sock", os.Getuid())
 		}
-		if err := fastagent.RunDaemon(socketPath, *allowUser, *idleTimeout, logger); err != nil {
+		if err := fastagent.RunDaemon(socketPath, *allowUser, *idleTimeout, *jobDir, logger); err != nil {
 			logger.Error("daemon failed", "error", err)
 			os.Exit(1)
 		}
@@ -78,7 +82,7 @@ func main() {
 
 	default:
 		fmt.Fprintln(os.Stderr, "usage: fastagent --serve")
-		fmt.Fprintln(os.Stderr, "       fastagent --daemon [--socket PATH]")
+		fmt.Fprintln(os.Stderr, "       fastagent --daemon [--socket PATH] [--job-dir DIR]")
 		fmt.Fprintln(os.Stderr, "       fastagent --connect [--socket PATH]")
 		fmt.Fprintln(os.Stderr, "       fastagent --version")
 		os.Exit(1)
@@ -0,0 +1,219 @@
+package fastagent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Compressions a controller can ask for in HelloParams.Compression.
+//
+// With CompressionGzip the byte stream in both directions (whatever its
+// framing) becomes a sequence of blocks:
+//
+//	1 byte kind: blockRaw or blockGzip
+//	uint32 data length, big-endian
+//	data
+//
+// Each message goes out as one or more blocks. A block is compressed only
+// when its content is at least the negotiated minimum size and compressing
+// actually shrinks it, so small responses like Stat pay five bytes rather
+// than a gzip header. Like framing, compression starts right after the
+// Hello response.
+//
+// There is no zstd: the module deliberately has no dependencies beyond
+// x/sys, and the standard library only has gzip.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// DefaultCompressMinSize is the smallest block worth compressing when the
+// controller doesn't say.
+const DefaultCompressMinSize = 512
+
+const (
+	blockRaw  = 0
+	blockGzip = 1
+
+	// maxBlockSize bounds a block's uncompressed content. Larger messages
+	// are split, so neither side has to hold a whole 64MB message
+	// compressed in memory.
+	maxBlockSize = 1 << 20
+)
+
+// blockWriter buffers one message and writes it out as blocks on flush.
+type blockWriter struct {
+	w       io.Writer
+	minSize int
+	pending bytes.Buffer
+	zbuf    bytes.Buffer
+	zw      *gzip.Writer
+}
+
+func newBlockWriter(w io.Writer, minSize int) *blockWriter {
+	zw, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+	return &blockWriter{w: w, minSize: minSize, zw: zw}
+}
+
+func (bw *blockWriter) Write(p []byte) (int, error) {
+	return bw.pending.Write(p)
+}
+
+func (bw *blockWriter) flush() error {
+	defer bw.pending.Reset()
+	data := bw.pending.Bytes()
+	for len(data) > 0 {
+		n := min(len(data), maxBlockSize)
+		if err := bw.writeBlock(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (bw *blockWriter) writeBlock(data []byte) error {
+	kind := byte(blockRaw)
+	if len(data) >= bw.minSize {
+		bw.zbuf.Reset()
+		bw.zw.Reset(&bw.zbuf)
+		if _, err := bw.zw.Write(data); err != nil {
+			return err
+		}
+		if err := bw.zw.Close(); err != nil {
+			return err
+		}
+		if bw.zbuf.Len() < len(data) {
+			kind = blockGzip
+			data = bw.zbuf.Bytes()
+		}
+	}
+	var prefix [5]byte
+	prefix[0] = kind
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(data)))
+	if _, err := bw.w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := bw.w.Write(data)
+	return err
+}
+
+// blockMessageWriter sends each message from inner as its own run of
+// blocks.
+type blockMessageWriter struct {
+	inner messageWriter
+	bw    *blockWriter
+}
+
+func (w *blockMessageWriter) writeMessage(v any, payload []byte) error {
+	if err := w.inner.writeMessage(v, payload); err != nil {
+		w.bw.pending.Reset()
+		return err
+	}
+	return w.bw.flush()
+}
+
+// blockReader undoes blockWriter, presenting the blocks' content as one
+// continuous stream for a messageReader to parse.
+type blockReader struct {
+	r   io.Reader
+	cur io.Reader
+	zr  *gzip.Reader
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	for {
+		if br.cur != nil {
+			n, err := br.cur.Read(p)
+			if err == io.EOF {
+				br.cur = nil
+				err = nil
+			}
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		if err := br.next(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// next starts reading the following block. EOF between blocks is a clean
+// end of input; anywhere else it's an error.
+func (br *blockReader) next() error {
+	var prefix [5]byte
+	if _, err := io.ReadFull(br.r, prefix[:]); err != nil {
+		if err == io.EOF {
+			return io.EOF
+		}
+		return unexpectedEOF(err)
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > maxBlockSize {
+		return fmt.Errorf("block too large: %d bytes", n)
+	}
+	data := &eofChecker{r: io.LimitReader(br.r, int64(n)), remaining: int64(n)}
+	switch prefix[0] {
+	case blockRaw:
+		br.cur = data
+	case blockGzip:
+		var err error
+		if br.zr == nil {
+			br.zr, err = gzip.NewReader(data)
+		} else {
+			err = br.zr.Reset(data)
+		}
+		if err != nil {
+			return fmt.Errorf("gzip block: %w", err)
+		}
+		br.zr.Multistream(false)
+		br.cur = &drainReader{r: br.zr, rest: data}
+	default:
+		return fmt.Errorf("unknown block kind %d", prefix[0])
+	}
+	return nil
+}
+
+// eofChecker reads exactly remaining bytes, turning an early EOF from the
+// underlying stream into io.ErrUnexpectedEOF.
+type eofChecker struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (e *eofChecker) Read(p []byte) (int, error) {
+	if e.remaining == 0 {
+		return 0, io.EOF
+	}
+	n, err := e.r.Read(p)
+	e.remaining -= int64(n)
+	if err == io.EOF && e.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// drainReader reads a gzip stream and then discards whatever of its block
+// the decompressor didn't consume, so the next block starts in the right
+// place.
+type drainReader struct {
+	r    io.Reader
+	rest *eofChecker
+}
+
+func (d *drainReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if err == io.EOF {
+		if _, cerr := io.Copy(io.Discard, d.rest); cerr != nil {
+			return n, cerr
+		}
+	} else if err != nil {
+		err = fmt.Errorf("gzip block: %w", err)
+	}
+	return n, err
+}
@@ -0,0 +1,136 @@
+package fastagent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBlockRoundTrip(t *testing.T) {
+	random := make([]byte, 3*maxBlockSize/2)
+	rand.Read(random)
+	messages := [][]byte{
+		[]byte("tiny"),
+		[]byte(strings.Repeat("compressible ", 300000)),
+		random,
+		{},
+		[]byte("after"),
+	}
+
+	var wire bytes.Buffer
+	bw := newBlockWriter(&wire, DefaultCompressMinSize)
+	var want bytes.Buffer
+	for _, m := range messages {
+		bw.Write(m)
+		if err := bw.flush(); err != nil {
+			t.Fatal(err)
+		}
+		want.Write(m)
+	}
+	if wire.Len() >= want.Len() {
+		t.Errorf("wire is %d bytes for %d bytes of content; expected compression", wire.Len(), want.Len())
+	}
+	// The first message is below the threshold and goes out raw.
+	if wire.Bytes()[0] != blockRaw {
+		t.Errorf("first block kind = %d, want raw", wire.Bytes()[0])
+	}
+
+	got, err := io.ReadAll(&blockReader{r: bufio.NewReader(&wire)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Fatalf("round trip mismatch: got %d bytes, want %d", len(got), want.Len())
+	}
+}
+
+func TestBlockReaderTruncated(t *testing.T) {
+	var wire bytes.Buffer
+	bw := newBlockWriter(&wire, DefaultCompressMinSize)
+	bw.Write([]byte(strings.Repeat("x", 4096)))
+	bw.flush()
+	truncated := wire.Bytes()[:wire.Len()-3]
+
+	_, err := io.ReadAll(&blockReader{r: bytes.NewReader(truncated)})
+	if err == nil || errors.Is(err, io.EOF) {
+		t.Fatalf("err = %v, want an error for a truncated block", err)
+	}
+}
+
+func TestServeCompressed(t *testing.T) {
+	for _, framing := range []string{FramingNDJSON, FramingBinary} {
+		t.Run(framing, func(t *testing.T) {
+			s := newTestServer()
+			inR, inW := io.Pipe()
+			outR, outW := io.Pipe()
+			done := make(chan error, 1)
+			go func() {
+				err := s.Serve(inR, outW)
+				outW.Close()
+				done <- err
+			}()
+			br := bufio.NewReader(outR)
+
+			hello, _ := json.Marshal(Request{ID: 1, Method: "Hello", Params: json.RawMessage(
+				`{"version":"test","framing":["` + framing + `"],"compression":["zstd","gzip"],"compress_min_size":64}`)})
+			inW.Write(append(hello, '\n'))
+			line, err := br.ReadBytes('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			var helloResp struct {
+				Result HelloResult `json:"result"`
+			}
+			if err := json.Unmarshal(line, &helloResp); err != nil {
+				t.Fatal(err)
+			}
+			if helloResp.Result.Compression != CompressionGzip || helloResp.Result.Framing != framing {
+				t.Fatalf("negotiated %+v, want %s with gzip", helloResp.Result, framing)
+			}
+
+			format := wireFormat{framing: framing, compression: CompressionGzip, compressMinSize: 64}
+			mw := format.writer(inW)
+			mr := format.reader(br)
+
+			// Big enough output to be compressed, plus a small response
+			// that shouldn't be.
+			for id, params := range []string{
+				`{"argv":["seq","1","5000"]}`,
+				`{"argv":["true"]}`,
+			} {
+				if err := mw.writeMessage(Request{ID: int64(id + 2), Method: "Exec", Params: json.RawMessage(params)}, nil); err != nil {
+					t.Fatal(err)
+				}
+				header, _, err := mr.readMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var resp struct {
+					ID     int64      `json:"id"`
+					Result ExecResult `json:"result"`
+					Error  *ErrorInfo `json:"error"`
+				}
+				if err := json.Unmarshal(header, &resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Error != nil || resp.ID != int64(id+2) || resp.Result.RC != 0 {
+					t.Fatalf("unexpected response %+v", resp)
+				}
+				if id == 0 && !strings.HasSuffix(resp.Result.Stdout, "\n5000") {
+					t.Errorf("stdout ends %q", resp.Result.Stdout[len(resp.Result.Stdout)-20:])
+				}
+			}
+
+			inW.Close()
+			go io.Copy(io.Discard, br)
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
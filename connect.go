@@ -10,7 +10,8 @@ import (
 
 // RunConnect dials the daemon's Unix socket and bridges stdin/stdout to it.
 // It copies stdin → socket and socket → stdout concurrently, exiting when
-// either direction closes.
+// either direction closes. The bytes are passed through untouched, so the
+// bridge carries any framing the controller and daemon negotiate.
 func RunConnect(socketPath string) error {
 	conn, err := net.Dial("unix", socketPath)
 	if err != nil {
@@ -25,7 +25,11 @@ const DefaultIdleTimeout = 1 * time.Hour
 // If a daemon is already running on socketPath (responds to Hello), it prints
 // the socket path and returns nil. Otherwise it removes any stale socket,
 // creates a new listener, and serves until interrupted or idle timeout.
-func RunDaemon(socketPath string, allowUser string, idleTimeout time.Duration, logger *slog.Logger) error {
+//
+// All connections share one Server, so background jobs started with
+// JobStart outlive the connection that submitted them. jobDir is passed
+// through as Server.JobDir.
+func RunDaemon(socketPath string, allowUser string, idleTimeout time.Duration, jobDir string, logger *slog.Logger) error {
 	// Check if a daemon is already running.
 	if isDaemonRunning(socketPath) {
 		fmt.Println(socketPath)
@@ -83,6 +87,8 @@ func RunDaemon(socketPath string, allowUser string, idleTimeout time.Duration, l
 		listener.Close()
 	}()
 
+	s := &Server{Logger: logger, JobDir: jobDir}
+
 	// Track active connections for idle timeout.
 	var activeConns atomic.Int64
 	var mu sync.Mutex
@@ -93,7 +99,9 @@ func RunDaemon(socketPath string, allowUser string, idleTimeout time.Duration, l
 		go func() {
 			for {
 				time.Sleep(1 * time.Minute)
-				if activeConns.Load() == 0 {
+				// A running background job counts as activity:
+				// shutting down would orphan it and lose its result.
+				if activeConns.Load() == 0 && s.runningJobs() == 0 {
 					mu.Lock()
 					idle := time.Since(lastActivity)
 					mu.Unlock()
@@ -135,7 +143,6 @@ func RunDaemon(socketPath string, allowUser string, idleTimeout time.Duration, l
 				mu.Unlock()
 				logger.Debug("connection closed", "active", activeConns.Load())
 			}()
-			s := &Server{Logger: logger}
 			if err := s.Serve(conn, conn); err != nil {
 				logger.Error("connection serve error", "error", err)
 			}
@@ -0,0 +1,151 @@
+package fastagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"os/user"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Error codes for ErrorInfo.Code. The negative ones are JSON-RPC's; the
+// small positive ones classify handler failures so a controller can decide
+// what to do (fall back to Python for CodeUnsupported, report a missing
+// file for CodeNotFound) without matching on messages, which aren't
+// stable.
+const (
+	CodeParseError     = -32700
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+
+	// CodeCancelled is returned for a request that was aborted by a
+	// Cancel RPC or by its connection closing. The value matches LSP's
+	// RequestCancelled.
+	CodeCancelled = -32800
+
+	// CodeFailed is any failure that fits none of the codes below.
+	CodeFailed = 1
+	// CodeNotFound: a file, directory, user, group, job, upload or
+	// executable doesn't exist.
+	CodeNotFound = 2
+	// CodePermissionDenied: the operating system refused the operation.
+	CodePermissionDenied = 3
+	// CodeUnsupported: the agent doesn't implement a parameter, value
+	// or combination of them. The controller should fall back to the
+	// builtin module. ErrorData.Param names the parameter.
+	CodeUnsupported = 4
+	// CodeTimeout: the operation didn't finish in time.
+	CodeTimeout = 5
+	// CodeConflict: the target is in a state that prevents the
+	// operation, e.g. a file where a directory should be, or a job ID
+	// that's already taken.
+	CodeConflict = 6
+	// CodeCommandFailed: an external command (apt-get, systemctl, ...)
+	// the handler ran failed. ErrorData carries its argv, rc and output.
+	CodeCommandFailed = 7
+)
+
+// Error is a handler error with a code from the list above. Handlers
+// return it where the code isn't evident from the wrapped error itself;
+// errorInfo classifies the rest (an ENOENT from the OS is CodeNotFound
+// without anyone saying so).
+type Error struct {
+	Code int
+	Data *ErrorData
+	Err  error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+func (e *Error) Unwrap() error { return e.Err }
+
+// newError returns an Error with the given code and a formatted message,
+// which may wrap another error with %w.
+func newError(code int, data *ErrorData, format string, args ...any) *Error {
+	return &Error{Code: code, Data: data, Err: fmt.Errorf(format, args...)}
+}
+
+// invalidParams reports a request whose params can't be decoded or are
+// missing something required.
+func invalidParams(format string, args ...any) error {
+	return newError(CodeInvalidParams, nil, format, args...)
+}
+
+// unsupported reports a parameter (or value of it) the agent doesn't
+// handle.
+func unsupported(param, format string, args ...any) error {
+	return newError(CodeUnsupported, &ErrorData{Param: param}, format, args...)
+}
+
+// commandError reports a failed external command. Its combined output
+// goes in both the message, as before, and Data.
+func commandError(what string, cmd *exec.Cmd, out []byte, err error) error {
+	data := &ErrorData{Cmd: cmd.Args, Stdout: string(out)}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		rc := exitErr.ExitCode()
+		data.RC = &rc
+	}
+	return &Error{
+		Code: CodeCommandFailed,
+		Data: data,
+		Err:  fmt.Errorf("%s: %s\n%s", what, err, string(out)),
+	}
+}
+
+// errorInfo converts a handler error to its wire form, classifying errors
+// that aren't an *Error by what they wrap.
+func errorInfo(err error) *ErrorInfo {
+	info := &ErrorInfo{Code: CodeFailed, Message: err.Error()}
+	var e *Error
+	if errors.As(err, &e) {
+		info.Code = e.Code
+		if e.Data != nil {
+			data := *e.Data
+			info.Data = &data
+		}
+	} else {
+		info.Code = classify(err)
+	}
+
+	// Fill in the errno and path from the OS error underneath, if any.
+	var errno syscall.Errno
+	var pathErr *fs.PathError
+	hasErrno, hasPath := errors.As(err, &errno), errors.As(err, &pathErr)
+	if hasErrno || hasPath {
+		if info.Data == nil {
+			info.Data = &ErrorData{}
+		}
+		if hasErrno && info.Data.Errno == "" {
+			info.Data.Errno = unix.ErrnoName(errno)
+		}
+		if hasPath && info.Data.Path == "" {
+			info.Data.Path = pathErr.Path
+		}
+	}
+	return info
+}
+
+func classify(err error) int {
+	var unknownUser user.UnknownUserError
+	var unknownGroup user.UnknownGroupError
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, exec.ErrNotFound),
+		errors.As(err, &unknownUser), errors.As(err, &unknownGroup):
+		return CodeNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return CodePermissionDenied
+	case errors.Is(err, fs.ErrExist), errors.Is(err, syscall.ENOTDIR),
+		errors.Is(err, syscall.EISDIR), errors.Is(err, syscall.ENOTEMPTY):
+		return CodeConflict
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeTimeout
+	case errors.As(err, &exitErr):
+		return CodeCommandFailed
+	}
+	return CodeFailed
+}
@@ -0,0 +1,70 @@
+package fastagent
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestErrorCodes(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		name   string
+		method string
+		params string
+		code   int
+		data   ErrorData
+	}{
+		{"unknown method", "Bogus", `{}`, CodeMethodNotFound, ErrorData{}},
+		{"bad params", "Stat", `{"path": 7}`, CodeInvalidParams, ErrorData{}},
+		{"missing file", "ReadFile", `{"path":"` + missing + `"}`, CodeNotFound, ErrorData{Errno: "ENOENT", Path: missing}},
+		{"unsupported param", "Stat", `{"path":"/","become_user":"nobody"}`, CodeUnsupported, ErrorData{Param: "become_user"}},
+		{"unsupported state", "File", `{"path":"` + file + `","state":"bogus"}`, CodeUnsupported, ErrorData{Param: "state"}},
+		{"conflict", "File", `{"path":"` + file + `","state":"directory"}`, CodeConflict, ErrorData{Path: file}},
+		{"missing executable", "Exec", `{"argv":["/nonexistent/fastagent-test"]}`, CodeNotFound, ErrorData{Errno: "ENOENT", Path: "/nonexistent/fastagent-test"}},
+		{"missing job", "JobStatus", `{"jid":"fastagent-nope"}`, CodeNotFound, ErrorData{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer()
+			s.JobDir = t.TempDir()
+			resp := rpcCallRawParams(t, s, tt.method, json.RawMessage(tt.params))
+			if resp.Error == nil {
+				t.Fatalf("expected an error, got %+v", resp.Result)
+			}
+			if resp.Error.Code != tt.code {
+				t.Errorf("code = %d, want %d (%s)", resp.Error.Code, tt.code, resp.Error.Message)
+			}
+			var got ErrorData
+			if resp.Error.Data != nil {
+				got = *resp.Error.Data
+			}
+			if got.Errno != tt.data.Errno || got.Path != tt.data.Path || got.Param != tt.data.Param {
+				t.Errorf("data = %+v, want %+v", got, tt.data)
+			}
+		})
+	}
+}
+
+func TestCommandError(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "echo oops; exit 3")
+	out, err := cmd.CombinedOutput()
+	info := errorInfo(commandError("sh", cmd, out, err))
+	if info.Code != CodeCommandFailed {
+		t.Errorf("code = %d, want %d", info.Code, CodeCommandFailed)
+	}
+	if info.Data == nil || info.Data.RC == nil || *info.Data.RC != 3 {
+		t.Fatalf("data = %+v, want rc 3", info.Data)
+	}
+	if info.Data.Stdout != "oops\n" || len(info.Data.Cmd) != 3 {
+		t.Errorf("data = %+v", info.Data)
+	}
+}
@@ -4,12 +4,17 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
 )
 
 // becomeUserCwd picks a working directory for an Exec when the caller
@@ -28,6 +33,76 @@ func becomeUserCwd(username string) string {
 	return "/"
 }
 
+// commandContext is exec.CommandContext, except that the child runs in its
+// own process group and cancellation kills the whole group. Killing just
+// the direct child would leave behind whatever a `/bin/sh -c` wrapper or
+// sudo had started, still running as root after the controller gave up.
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return unix.Kill(-cmd.Process.Pid, unix.SIGKILL)
+	}
+	return cmd
+}
+
+// outputStreamer forwards a child's output to the controller as ExecOutput
+// notifications while it runs. Each Write is sent as it arrives, except
+// that a trailing partial UTF-8 sequence is held back until the rest of
+// the character shows up; otherwise a character split across two reads
+// would be mangled into U+FFFD on both sides of the split.
+type outputStreamer struct {
+	c       *call
+	stderr  bool
+	pending []byte
+}
+
+func (w *outputStreamer) Write(b []byte) (int, error) {
+	data := b
+	if len(w.pending) > 0 {
+		data = append(w.pending, b...)
+	}
+	n := completeUTF8(data)
+	w.pending = append([]byte(nil), data[n:]...)
+	if n > 0 {
+		w.send(data[:n])
+	}
+	return len(b), nil
+}
+
+// flush sends anything held back by Write. Called once the child exits.
+func (w *outputStreamer) flush() {
+	if len(w.pending) > 0 {
+		w.send(w.pending)
+		w.pending = nil
+	}
+}
+
+func (w *outputStreamer) send(b []byte) {
+	out := ExecOutput{ID: w.c.id}
+	if w.stderr {
+		out.Stderr = string(b)
+	} else {
+		out.Stdout = string(b)
+	}
+	w.c.notify("ExecOutput", out)
+}
+
+// completeUTF8 returns the length of the longest prefix of b that doesn't
+// end partway through a UTF-8 sequence. Invalid bytes count as complete,
+// so at most utf8.UTFMax-1 bytes are ever held back.
+func completeUTF8(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i > len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) {
+				return len(b)
+			}
+			return i
+		}
+	}
+	return len(b)
+}
+
 func commandPathMatches(pattern, cwd string) (bool, error) {
 	if pattern == "" {
 		return false, nil
@@ -37,15 +112,15 @@ func commandPathMatches(pattern, cwd string) (bool, error) {
 	}
 	matches, err := filepath.Glob(pattern)
 	if err != nil {
-		return false, fmt.Errorf("bad path pattern %q: %w", pattern, err)
+		return false, invalidParams("bad path pattern %q: %w", pattern, err)
 	}
 	return len(matches) > 0, nil
 }
 
-func (s *Server) handleExec(params json.RawMessage) (any, error) {
+func (s *Server) handleExec(ctx context.Context, params json.RawMessage) (any, error) {
 	var p ExecParams
 	if err := json.Unmarshal(params, &p); err != nil {
-		return nil, fmt.Errorf("unmarshal ExecParams: %w", err)
+		return nil, invalidParams("unmarshal ExecParams: %w", err)
 	}
 	if p.Cwd != "" {
 		fi, err := os.Stat(p.Cwd)
@@ -53,14 +128,14 @@ func (s *Server) handleExec(params json.RawMessage) (any, error) {
 			return nil, fmt.Errorf("exec: chdir %q: %w", p.Cwd, err)
 		}
 		if !fi.IsDir() {
-			return nil, fmt.Errorf("exec: chdir %q: not a directory", p.Cwd)
+			return nil, newError(CodeConflict, &ErrorData{Errno: "ENOTDIR", Path: p.Cwd}, "exec: chdir %q: not a directory", p.Cwd)
 		}
 	}
 
 	// Handle creates/removes short-circuit.
 	if p.Creates != "" {
 		if p.BecomeUser != "" {
-			return nil, fmt.Errorf("exec: creates with become_user is not implemented; use the builtin command module")
+			return nil, unsupported("creates", "exec: creates with become_user is not implemented; use the builtin command module")
 		}
 		ok, err := commandPathMatches(p.Creates, p.Cwd)
 		if err != nil {
@@ -77,7 +152,7 @@ func (s *Server) handleExec(params json.RawMessage) (any, error) {
 	}
 	if p.Removes != "" {
 		if p.BecomeUser != "" {
-			return nil, fmt.Errorf("exec: removes with become_user is not implemented; use the builtin command module")
+			return nil, unsupported("removes", "exec: removes with become_user is not implemented; use the builtin command module")
 		}
 		ok, err := commandPathMatches(p.Removes, p.Cwd)
 		if err != nil {
@@ -93,7 +168,7 @@ func (s *Server) handleExec(params json.RawMessage) (any, error) {
 		}
 	}
 
-	ctx := context.Background()
+	reqCtx := ctx
 	if p.TimeoutSeconds > 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, time.Duration(p.TimeoutSeconds)*time.Second)
@@ -133,9 +208,9 @@ func (s *Server) handleExec(params json.RawMessage) (any, error) {
 	case len(p.Argv) > 0:
 		finalArgv = p.Argv
 	case p.CmdString != "":
-		return nil, fmt.Errorf("exec: cmd_string without use_shell is not supported; send argv")
+		return nil, unsupported("cmd_string", "exec: cmd_string without use_shell is not supported; send argv")
 	default:
-		return nil, fmt.Errorf("no command specified: set argv or cmd_string")
+		return nil, invalidParams("no command specified: set argv or cmd_string")
 	}
 	if p.BecomeUser != "" {
 		finalArgv = append(
@@ -149,7 +224,7 @@ func (s *Server) handleExec(params json.RawMessage) (any, error) {
 			finalArgv...,
 		)
 	}
-	cmd := exec.CommandContext(ctx, finalArgv[0], finalArgv[1:]...)
+	cmd := commandContext(ctx, finalArgv[0], finalArgv[1:]...)
 
 	if p.Cwd != "" {
 		cmd.Dir = p.Cwd
@@ -174,8 +249,19 @@ func (s *Server) handleExec(params json.RawMessage) (any, error) {
 	var stdout, stderr strings.Builder
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
+	if c := callFromContext(reqCtx); p.Stream && c != nil {
+		outStream := &outputStreamer{c: c, stderr: false}
+		errStream := &outputStreamer{c: c, stderr: true}
+		cmd.Stdout = io.MultiWriter(&stdout, outStream)
+		cmd.Stderr = io.MultiWriter(&stderr, errStream)
+		defer outStream.flush()
+		defer errStream.flush()
+	}
 
 	err := cmd.Run()
+	if err := reqCtx.Err(); err != nil {
+		return nil, fmt.Errorf("exec: %w", err)
+	}
 	rc := 0
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
@@ -25,21 +25,109 @@ type Response struct {
 	Error  *ErrorInfo `json:"error,omitempty"`
 }
 
+// Notification is a message from the agent that isn't a reply to any one
+// request. It has no top-level ID, so a controller reading responses can
+// tell the two apart by the presence of Method.
+type Notification struct {
+	Method string `json:"method"`
+	Params any    `json:"params"`
+}
+
 // ErrorInfo describes an error in a Response.
 type ErrorInfo struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Code    int        `json:"code"`
+	Message string     `json:"message"`
+	Data    *ErrorData `json:"data,omitempty"`
+}
+
+// ErrorData is the structured detail of an error, where there is any.
+type ErrorData struct {
+	// Errno is the symbolic name of the OS error underneath, e.g. "ENOENT".
+	Errno string `json:"errno,omitempty"`
+	Path  string `json:"path,omitempty"`
+	// Param names the offending request parameter.
+	Param string `json:"param,omitempty"`
+	// Cmd, RC, Stdout and Stderr describe a failed external command.
+	// Commands run with combined output report it all as Stdout.
+	Cmd    []string `json:"cmd,omitempty"`
+	RC     *int     `json:"rc,omitempty"`
+	Stdout string   `json:"stdout,omitempty"`
+	Stderr string   `json:"stderr,omitempty"`
 }
 
 // HelloParams is sent by the controller on connect.
 type HelloParams struct {
 	Version string `json:"version"`
+	// Framing lists the framings the controller can speak, most preferred
+	// first. Empty means NDJSON only.
+	Framing []string `json:"framing,omitempty"`
+	// Compression lists the compressions the controller can handle, most
+	// preferred first. Empty means none.
+	Compression []string `json:"compression,omitempty"`
+	// CompressMinSize is the smallest block worth compressing. Zero means
+	// DefaultCompressMinSize.
+	CompressMinSize int `json:"compress_min_size,omitempty"`
+	// ProtocolMin and ProtocolMax are the range of protocol versions the
+	// controller speaks. Zero means 1.
+	ProtocolMin int `json:"protocol_min,omitempty"`
+	ProtocolMax int `json:"protocol_max,omitempty"`
 }
 
 // HelloResult is returned by the agent in response to Hello.
 type HelloResult struct {
 	Version      string   `json:"version"`
 	Capabilities []string `json:"capabilities"`
+	// Framing is the framing used for every message after this response.
+	Framing string `json:"framing"`
+	// Compression likewise applies after this response.
+	Compression string `json:"compression"`
+	// Protocol is the protocol version agreed on: the highest both sides
+	// speak.
+	Protocol int `json:"protocol"`
+	// Methods describes each method the agent handles.
+	Methods map[string]MethodInfo `json:"methods"`
+}
+
+// MethodInfo describes what a method supports, so a controller can decide
+// up front whether a task can use it rather than finding out from an error.
+type MethodInfo struct {
+	// Params are the params the method honors.
+	Params []string `json:"params"`
+	// States, Managers and ChecksumAlgorithms list the accepted values of
+	// the params of those names, for methods that have them.
+	States             []string `json:"states,omitempty"`
+	Managers           []string `json:"managers,omitempty"`
+	ChecksumAlgorithms []string `json:"checksum_algorithms,omitempty"`
+}
+
+// CancelParams asks the agent to abort an in-flight request on the same
+// connection.
+type CancelParams struct {
+	ID int64 `json:"id"`
+}
+
+// CancelResult reports whether the request was still in flight. The
+// cancelled request answers separately with a CodeCancelled error.
+type CancelResult struct {
+	Cancelled bool `json:"cancelled"`
+}
+
+// BatchParams runs several requests in order in one round trip. Any method
+// but Hello and Batch may appear; the sub-requests' IDs are only echoed
+// back in their results. In binary framing, file content in a batch still
+// travels base64-encoded in the params.
+type BatchParams struct {
+	Requests []Request `json:"requests"`
+	// StopOnError ends the batch at the first sub-request that fails.
+	// Otherwise every sub-request runs regardless.
+	StopOnError bool `json:"stop_on_error,omitempty"`
+}
+
+// BatchResult holds one response per sub-request that ran, in order. When
+// StopOnError ends a batch early, the failing sub-request's response is
+// the last one.
+type BatchResult struct {
+	Results []Response `json:"results"`
 }
 
 // ExecParams describes a command to execute.
@@ -61,6 +149,10 @@ type ExecParams struct {
 	StdinAddNewline *bool             `json:"stdin_add_newline,omitempty"`
 	StripEmptyEnds  *bool             `json:"strip_empty_ends,omitempty"`
 	BecomeUser      string            `json:"become_user,omitempty"`
+
+	// Stream asks for the command's output as ExecOutput notifications
+	// while it runs, in addition to the final ExecResult.
+	Stream bool `json:"stream,omitempty"`
 }
 
 // UnmarshalJSON accepts the heterogeneous argv lists Ansible can produce when
@@ -155,6 +247,59 @@ type ExecResult struct {
 	Msg     string `json:"msg,omitempty"`
 }
 
+// ExecOutput is the params of an "ExecOutput" notification, sent while a
+// streaming Exec runs. ID is the ID of the Exec request. Each notification
+// carries whatever the child wrote since the last one; chunks end on UTF-8
+// character boundaries but not necessarily on line boundaries. Output is
+// sent as-is, before strip_empty_ends is applied to the final result.
+type ExecOutput struct {
+	ID     int64  `json:"id"`
+	Stdout string `json:"stdout,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+}
+
+// JobStartParams starts Exec as a background job, the fast-path
+// equivalent of Ansible's `async:`. JobID is optional; the agent picks
+// one if it's empty. Exec.TimeoutSeconds bounds the job's runtime the way
+// the `async:` value does.
+type JobStartParams struct {
+	JobID string     `json:"jid,omitempty"`
+	Exec  ExecParams `json:"exec"`
+}
+
+// JobStatusParams asks for a job's status. Cleanup removes the result of a
+// finished job afterwards, like async_status's mode=cleanup.
+type JobStatusParams struct {
+	JobID   string `json:"jid"`
+	Cleanup bool   `json:"cleanup,omitempty"`
+}
+
+// JobWaitParams blocks until a job finishes or TimeoutSeconds elapses
+// (zero waits indefinitely), then returns its status.
+type JobWaitParams struct {
+	JobID          string `json:"jid"`
+	TimeoutSeconds int    `json:"timeout,omitempty"`
+}
+
+// JobKillParams kills a running job's process group and returns its final
+// status.
+type JobKillParams struct {
+	JobID string `json:"jid"`
+}
+
+// JobStatusResult describes a background job in the shape async_status
+// returns: started/finished flags plus, once the job has finished, the
+// ExecResult fields at the top level. Failed is set when the command
+// couldn't be run at all (or was killed), with the reason in Msg.
+type JobStatusResult struct {
+	JobID       string `json:"ansible_job_id"`
+	Started     int    `json:"started"`
+	Finished    int    `json:"finished"`
+	ResultsFile string `json:"results_file,omitempty"`
+	Failed      bool   `json:"failed,omitempty"`
+	*ExecResult
+}
+
 // StatParams requests file status information.
 //
 // BecomeUser is accepted on the wire but not yet implemented: stat
@@ -244,7 +389,8 @@ type ReadFileParams struct {
 	BecomeUser string `json:"become_user,omitempty"`
 }
 
-// ReadFileResult contains the file content, base64-encoded.
+// ReadFileResult contains the file content, base64-encoded. In binary
+// framing Content is empty and the content is the frame payload.
 type ReadFileResult struct {
 	Content string `json:"content"`
 	Size    int64  `json:"size"`
@@ -253,7 +399,7 @@ type ReadFileResult struct {
 // WriteFileParams writes a file atomically.
 type WriteFileParams struct {
 	Dest         string `json:"dest"`
-	Content      string `json:"content"` // base64-encoded
+	Content      string `json:"content"` // base64-encoded; empty in binary framing, which uses the payload
 	Owner        string `json:"owner,omitempty"`
 	Group        string `json:"group,omitempty"`
 	Mode         string `json:"mode,omitempty"`
@@ -261,6 +407,7 @@ type WriteFileParams struct {
 	UnsafeWrites bool   `json:"unsafe_writes,omitempty"`
 	Validate     string `json:"validate,omitempty"`
 	Checksum     string `json:"checksum,omitempty"` // expected checksum of existing file; skip write if matches
+	BecomeUser   string `json:"become_user,omitempty"`
 }
 
 // WriteFileResult is the result of a file write.
@@ -271,6 +418,73 @@ type WriteFileResult struct {
 	BackupFile string `json:"backup_file,omitempty"`
 }
 
+// WriteFileBeginParams starts a chunked upload. The fields of
+// WriteFileParams mean what they do for WriteFile, except that Content is
+// ignored: the content arrives in WriteFileChunk calls. SHA256 is the
+// expected checksum of the complete content; it can be given here or at
+// commit.
+type WriteFileBeginParams struct {
+	WriteFileParams
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// WriteFileBeginResult identifies the upload in later chunk and commit
+// calls, which must arrive on the same connection.
+type WriteFileBeginResult struct {
+	UploadID string `json:"upload_id"`
+}
+
+// WriteFileChunkParams carries one piece of an upload. Chunks may be sent
+// without waiting for each other and in any order; each lands at Offset.
+type WriteFileChunkParams struct {
+	UploadID string `json:"upload_id"`
+	Offset   int64  `json:"offset"`
+	Content  string `json:"content"` // base64-encoded; empty in binary framing, which uses the payload
+}
+
+// WriteFileChunkResult reports the total bytes received so far.
+type WriteFileChunkResult struct {
+	Received int64 `json:"received"`
+}
+
+// WriteFileCommitParams finishes an upload. The agent checks the SHA-256
+// of what it received against SHA256 (or the one given at begin), then
+// installs the file the way WriteFile does and returns a WriteFileResult.
+type WriteFileCommitParams struct {
+	UploadID string `json:"upload_id"`
+	SHA256   string `json:"sha256,omitempty"`
+}
+
+// WriteFileAbortParams discards an upload.
+type WriteFileAbortParams struct {
+	UploadID string `json:"upload_id"`
+}
+
+// WriteFileAbortResult reports whether the upload still existed.
+type WriteFileAbortResult struct {
+	Aborted bool `json:"aborted"`
+}
+
+// ReadFileChunkParams requests up to Length bytes of a file starting at
+// Offset. Length defaults to 4MB and is capped at 16MB.
+//
+// BecomeUser is handled as in ReadFileParams.
+type ReadFileChunkParams struct {
+	Path       string `json:"path"`
+	Offset     int64  `json:"offset"`
+	Length     int    `json:"length,omitempty"`
+	BecomeUser string `json:"become_user,omitempty"`
+}
+
+// ReadFileChunkResult holds one chunk of a file. Size is the file's
+// current total size; EOF is set on the chunk that reaches it.
+type ReadFileChunkResult struct {
+	Content string `json:"content"` // base64-encoded; empty in binary framing, which uses the payload
+	Offset  int64  `json:"offset"`
+	Size    int64  `json:"size"`
+	EOF     bool   `json:"eof"`
+}
+
 // FileParams manages file/directory/link state.
 type FileParams struct {
 	Path    string `json:"path"`
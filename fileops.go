@@ -1,11 +1,11 @@
 package fastagent
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
-	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -23,20 +23,18 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func (s *Server) handleStat(params json.RawMessage) (any, error) {
+func (s *Server) handleStat(ctx context.Context, params json.RawMessage) (any, error) {
 	var p StatParams
 	if err := json.Unmarshal(params, &p); err != nil {
-		return nil, fmt.Errorf("unmarshal StatParams: %w", err)
+		return nil, invalidParams("unmarshal StatParams: %w", err)
 	}
 	// Stat running as the agent's uid (typically root) could leak the
-	// existence or metadata of files the BecomeUser couldn't see. We
-	// should support this at some point — probably by stat'ing from a
-	// helper subprocess that has dropped to BecomeUser — but we
-	// haven't built that yet. Until then, refuse rather than silently
-	// upgrade permissions. Callers fall back to `stat` via the Exec
-	// RPC, which does support BecomeUser.
+	// existence or metadata of files the BecomeUser couldn't see, so
+	// it runs in a helper that has dropped to BecomeUser instead.
 	if p.BecomeUser != "" {
-		return nil, fmt.Errorf("stat: BecomeUser is not yet implemented (use Exec with `stat`/`test` to run as a specific user)")
+		username := p.BecomeUser
+		p.BecomeUser = ""
+		return s.runAsUser(ctx, username, "Stat", p)
 	}
 
 	var st unix.Stat_t
@@ -148,17 +146,17 @@ func (s *Server) handleStat(params json.RawMessage) (any, error) {
 	return result, nil
 }
 
-func (s *Server) handleReadFile(params json.RawMessage) (any, error) {
+func (s *Server) handleReadFile(ctx context.Context, params json.RawMessage) (any, error) {
 	var p ReadFileParams
 	if err := json.Unmarshal(params, &p); err != nil {
-		return nil, fmt.Errorf("unmarshal ReadFileParams: %w", err)
+		return nil, invalidParams("unmarshal ReadFileParams: %w", err)
 	}
 	// Same rationale as Stat: reading as the agent's uid could expose
-	// file contents BecomeUser wouldn't have read access to. We should
-	// support this eventually (likely via a helper subprocess that
-	// drops to BecomeUser), but haven't built it yet.
+	// file contents BecomeUser wouldn't have read access to.
 	if p.BecomeUser != "" {
-		return nil, fmt.Errorf("read_file: BecomeUser is not yet implemented (use Exec with `cat` to read as a specific user)")
+		username := p.BecomeUser
+		p.BecomeUser = ""
+		return s.runAsUser(ctx, username, "ReadFile", p)
 	}
 
 	data, err := os.ReadFile(p.Path)
@@ -167,26 +165,68 @@ func (s *Server) handleReadFile(params json.RawMessage) (any, error) {
 	}
 
 	return ReadFileResult{
-		Content: base64.StdEncoding.EncodeToString(data),
+		Content: responseContent(ctx, data),
 		Size:    int64(len(data)),
 	}, nil
 }
 
-func (s *Server) handleWriteFile(params json.RawMessage) (any, error) {
+func (s *Server) handleWriteFile(ctx context.Context, params json.RawMessage) (any, error) {
 	var p WriteFileParams
 	if err := json.Unmarshal(params, &p); err != nil {
-		return nil, fmt.Errorf("unmarshal WriteFileParams: %w", err)
+		return nil, invalidParams("unmarshal WriteFileParams: %w", err)
+	}
+	// Writing as BecomeUser means the user's permissions decide whether
+	// the write is allowed, and the file ends up owned by them, as with
+	// the builtin copy module.
+	if p.BecomeUser != "" {
+		username := p.BecomeUser
+		p.BecomeUser = ""
+		return s.runAsUser(ctx, username, "WriteFile", p)
 	}
 
-	data, err := base64.StdEncoding.DecodeString(p.Content)
+	data, err := requestContent(ctx, p.Content)
 	if err != nil {
-		return nil, fmt.Errorf("decode content: %w", err)
+		return nil, err
 	}
 
 	// Compute checksum of new content.
 	h := sha256.Sum256(data)
 	newChecksum := hex.EncodeToString(h[:])
 
+	return finishWrite(p, newChecksum, func(dir string) error {
+		if p.UnsafeWrites {
+			if err := os.WriteFile(p.Dest, data, 0o644); err != nil {
+				return fmt.Errorf("write %s: %w", p.Dest, err)
+			}
+			return nil
+		}
+		tmp, err := os.CreateTemp(dir, ".fastagent-*")
+		if err != nil {
+			return fmt.Errorf("create temp: %w", err)
+		}
+		tmpName := tmp.Name()
+		if _, err := tmp.Write(data); err != nil {
+			tmp.Close()
+			os.Remove(tmpName)
+			return fmt.Errorf("write temp: %w", err)
+		}
+		if err := tmp.Close(); err != nil {
+			os.Remove(tmpName)
+			return fmt.Errorf("close temp: %w", err)
+		}
+		if err := os.Rename(tmpName, p.Dest); err != nil {
+			os.Remove(tmpName)
+			return fmt.Errorf("rename temp to %s: %w", p.Dest, err)
+		}
+		return nil
+	})
+}
+
+// finishWrite does the part of a WriteFile that doesn't depend on how the
+// new content arrived: the checksum short-circuit, backup, creating parent
+// directories, and ownership/mode. place is called to put content with
+// checksum newChecksum at p.Dest once dir (its parent) exists.
+func finishWrite(p WriteFileParams, newChecksum string, place func(dir string) error) (WriteFileResult, error) {
 	// If the caller already knows the existing file's checksum, use it to
 	// skip the disk read. Otherwise read the file to check.
 	existingChecksum := p.Checksum
@@ -198,7 +238,7 @@ func (s *Server) handleWriteFile(params json.RawMessage) (any, error) {
 		// File already has the correct content; still apply ownership/mode if needed.
 		changed, err := applyOwnershipAndMode(p.Dest, p.Owner, p.Group, p.Mode)
 		if err != nil {
-			return nil, err
+			return WriteFileResult{}, err
 		}
 		return WriteFileResult{
 			Changed:  changed,
@@ -213,7 +253,7 @@ func (s *Server) handleWriteFile(params json.RawMessage) (any, error) {
 		if _, statErr := os.Stat(p.Dest); statErr == nil {
 			backupFile = p.Dest + "." + time.Now().Format("20060102150405") + "~"
 			if err := copyFile(p.Dest, backupFile); err != nil {
-				return nil, fmt.Errorf("backup %s: %w", p.Dest, err)
+				return WriteFileResult{}, fmt.Errorf("backup %s: %w", p.Dest, err)
 			}
 		}
 	}
@@ -230,36 +270,15 @@ func (s *Server) handleWriteFile(params json.RawMessage) (any, error) {
 	// ancestors are left untouched (matching ansible's file module).
 	dir := filepath.Dir(p.Dest)
 	if err := mkdirAllOwned(dir, p.Owner, p.Group); err != nil {
-		return nil, err
+		return WriteFileResult{}, err
 	}
 
-	if p.UnsafeWrites {
-		if err := os.WriteFile(p.Dest, data, 0o644); err != nil {
-			return nil, fmt.Errorf("write %s: %w", p.Dest, err)
-		}
-	} else {
-		tmp, err := os.CreateTemp(dir, ".fastagent-*")
-		if err != nil {
-			return nil, fmt.Errorf("create temp: %w", err)
-		}
-		tmpName := tmp.Name()
-		if _, err := tmp.Write(data); err != nil {
-			tmp.Close()
-			os.Remove(tmpName)
-			return nil, fmt.Errorf("write temp: %w", err)
-		}
-		if err := tmp.Close(); err != nil {
-			os.Remove(tmpName)
-			return nil, fmt.Errorf("close temp: %w", err)
-		}
-		if err := os.Rename(tmpName, p.Dest); err != nil {
-			os.Remove(tmpName)
-			return nil, fmt.Errorf("rename temp to %s: %w", p.Dest, err)
-		}
+	if err := place(dir); err != nil {
+		return WriteFileResult{}, err
 	}
 
 	if _, err := applyOwnershipAndMode(p.Dest, p.Owner, p.Group, p.Mode); err != nil {
-		return nil, err
+		return WriteFileResult{}, err
 	}
 
 	return WriteFileResult{
@@ -270,10 +289,13 @@ func (s *Server) handleWriteFile(params json.RawMessage) (any, error) {
 	}, nil
 }
 
-func (s *Server) handleFile(params json.RawMessage) (any, error) {
+// fileStates are the states handleFile accepts.
+var fileStates = []string{"directory", "file", "link", "hard", "touch", "absent"}
+
+func (s *Server) handleFile(ctx context.Context, params json.RawMessage) (any, error) {
 	var p FileParams
 	if err := json.Unmarshal(params, &p); err != nil {
-		return nil, fmt.Errorf("unmarshal FileParams: %w", err)
+		return nil, invalidParams("unmarshal FileParams: %w", err)
 	}
 
 	switch p.State {
@@ -288,7 +310,7 @@ func (s *Server) handleFile(params json.RawMessage) (any, error) {
 	case "absent":
 		return s.handleFileAbsent(p)
 	default:
-		return nil, fmt.Errorf("unknown file state: %q", p.State)
+		return nil, unsupported("state", "unknown file state: %q", p.State)
 	}
 }
 
@@ -324,7 +346,7 @@ func ensureDirectoryAnsible(path, owner, group, mode string) (bool, error) {
 	info, err := os.Stat(path)
 	if err == nil {
 		if !info.IsDir() {
-			return false, fmt.Errorf("%s exists but is not a directory", path)
+			return false, newError(CodeConflict, &ErrorData{Path: path}, "%s exists but is not a directory", path)
 		}
 		// Path already exists: ansible only touches the leaf's attrs,
 		// not any ancestor's.
@@ -467,7 +489,7 @@ func recursivelySetAttributesFollow(path, owner, group, mode string, seen map[fi
 func mkdirAllOwned(dir, owner, group string) error {
 	if info, err := os.Stat(dir); err == nil {
 		if !info.IsDir() {
-			return fmt.Errorf("%s exists but is not a directory", dir)
+			return newError(CodeConflict, &ErrorData{Path: dir}, "%s exists but is not a directory", dir)
 		}
 		return nil
 	} else if !os.IsNotExist(err) {
@@ -502,13 +524,13 @@ func mkdirAllOwned(dir, owner, group string) error {
 func (s *Server) handleFileFile(p FileParams) (any, error) {
 	info, err := os.Stat(p.Path)
 	if os.IsNotExist(err) {
-		return nil, fmt.Errorf("%s does not exist; use state=touch to create", p.Path)
+		return nil, newError(CodeNotFound, &ErrorData{Path: p.Path}, "%s does not exist; use state=touch to create", p.Path)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("stat %s: %w", p.Path, err)
 	}
 	if info.IsDir() {
-		return nil, fmt.Errorf("%s is a directory, cannot use state=file", p.Path)
+		return nil, newError(CodeConflict, &ErrorData{Path: p.Path}, "%s is a directory, cannot use state=file", p.Path)
 	}
 
 	changed, err := applyOwnershipAndMode(p.Path, p.Owner, p.Group, p.Mode)
@@ -520,7 +542,7 @@ func (s *Server) handleFileFile(p FileParams) (any, error) {
 
 func (s *Server) handleFileLink(p FileParams) (any, error) {
 	if p.Src == "" {
-		return nil, fmt.Errorf("src is required for state=%s", p.State)
+		return nil, invalidParams("src is required for state=%s", p.State)
 	}
 
 	changed := false
@@ -589,6 +611,9 @@ func (s *Server) handleFileAbsent(p FileParams) (any, error) {
 	return FileResult{Changed: true, Path: p.Path, State: "absent"}, nil
 }
 
+// checksumAlgorithms are the names digestFile accepts.
+var checksumAlgorithms = []string{"md5", "sha1", "sha224", "sha256", "sha384", "sha512"}
+
 // digestFile computes a hex digest for the algorithms supported by
 // ansible.builtin.stat's checksum_algorithm parameter.
 func digestFile(path, algorithm string) (string, error) {
@@ -607,7 +632,7 @@ func digestFile(path, algorithm string) (string, error) {
 	case "sha512":
 		h = sha512.New()
 	default:
-		return "", fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+		return "", unsupported("checksum_algorithm", "unsupported checksum algorithm %q", algorithm)
 	}
 
 	f, err := os.Open(path)
@@ -661,7 +686,7 @@ func applyOwnershipAndModeWithChown(path, owner, group, mode string, lchown bool
 	if mode != "" {
 		m, err := strconv.ParseUint(mode, 8, 32)
 		if err != nil {
-			return false, fmt.Errorf("parse mode %q: %w", mode, err)
+			return false, invalidParams("parse mode %q: %w", mode, err)
 		}
 		skipMode := false
 		if lchown {
@@ -0,0 +1,210 @@
+package fastagent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Framings a controller can ask for in HelloParams.Framing.
+//
+// FramingNDJSON is the default: one JSON message per line, with file
+// content base64-encoded inside it.
+//
+// FramingBinary carries each message as a frame:
+//
+//	uint32 header length, big-endian
+//	uint32 payload length, big-endian
+//	header: the JSON Request, Response, or Notification
+//	payload: raw bytes
+//
+// The payload carries file content that NDJSON would base64 into the
+// message: WriteFile and WriteFileChunk read their content from it (with
+// the "content" param left empty), and ReadFile and ReadFileChunk return
+// their content in it (with "content" empty in the result). Every other
+// message has an empty payload.
+//
+// The switch happens right after the Hello response, which is itself
+// still NDJSON. A controller asking for binary framing must wait for that
+// response before sending anything else.
+const (
+	FramingNDJSON = "ndjson"
+	FramingBinary = "binary"
+)
+
+// maxMessageSize bounds a single message (or frame header, or frame
+// payload). The NDJSON limit used to be the only one, applied to whole
+// lines including base64 file content.
+const maxMessageSize = 64 * 1024 * 1024
+
+// messageReader reads requests in one framing.
+type messageReader interface {
+	// readMessage returns the JSON of the next message and, for
+	// framings that have one, its payload. It returns io.EOF at a clean
+	// end of input.
+	readMessage() (header, payload []byte, err error)
+}
+
+// messageWriter writes messages in one framing.
+type messageWriter interface {
+	writeMessage(v any, payload []byte) error
+}
+
+// wireFormat is how a connection's messages are carried, as negotiated by
+// Hello.
+type wireFormat struct {
+	framing         string
+	compression     string
+	compressMinSize int
+}
+
+var defaultWireFormat = wireFormat{framing: FramingNDJSON, compression: CompressionNone}
+
+func (f wireFormat) reader(br *bufio.Reader) messageReader {
+	if f.compression == CompressionGzip {
+		br = bufio.NewReaderSize(&blockReader{r: br}, 64*1024)
+	}
+	return newMessageReader(f.framing, br)
+}
+
+func (f wireFormat) writer(w io.Writer) messageWriter {
+	if f.compression == CompressionGzip {
+		bw := newBlockWriter(w, f.compressMinSize)
+		return &blockMessageWriter{inner: newMessageWriter(f.framing, bw), bw: bw}
+	}
+	return newMessageWriter(f.framing, w)
+}
+
+func newMessageReader(framing string, br *bufio.Reader) messageReader {
+	if framing == FramingBinary {
+		return &frameReader{br: br}
+	}
+	return &lineReader{br: br}
+}
+
+func newMessageWriter(framing string, w io.Writer) messageWriter {
+	if framing == FramingBinary {
+		return &frameWriter{w: w}
+	}
+	return &lineWriter{enc: json.NewEncoder(w)}
+}
+
+type lineReader struct {
+	br *bufio.Reader
+}
+
+func (r *lineReader) readMessage() ([]byte, []byte, error) {
+	for {
+		line, err := readLine(r.br)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(line) > 0 {
+			return line, nil, nil
+		}
+	}
+}
+
+// readLine reads one line, without its line ending, like bufio.Scanner
+// with ScanLines. The returned slice is only valid until the next read.
+func readLine(br *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := br.ReadSlice('\n')
+		if len(line)+len(frag) > maxMessageSize {
+			return nil, bufio.ErrTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			line = append(line, frag...)
+			continue
+		}
+		if line == nil {
+			line = frag
+		} else {
+			line = append(line, frag...)
+		}
+		if err != nil {
+			// A final line without a newline still counts.
+			if errors.Is(err, io.EOF) && len(line) > 0 {
+				break
+			}
+			return nil, err
+		}
+		break
+	}
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+	}
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return line, nil
+}
+
+type lineWriter struct {
+	enc *json.Encoder
+}
+
+// writeMessage ignores payload: handlers only produce one when the request
+// arrived in binary framing.
+func (w *lineWriter) writeMessage(v any, payload []byte) error {
+	return w.enc.Encode(v)
+}
+
+type frameReader struct {
+	br *bufio.Reader
+}
+
+func (r *frameReader) readMessage() ([]byte, []byte, error) {
+	var prefix [8]byte
+	if _, err := io.ReadFull(r.br, prefix[:]); err != nil {
+		return nil, nil, err
+	}
+	headerLen := binary.BigEndian.Uint32(prefix[0:4])
+	payloadLen := binary.BigEndian.Uint32(prefix[4:8])
+	if headerLen > maxMessageSize || payloadLen > maxMessageSize {
+		return nil, nil, fmt.Errorf("frame too large: header %d bytes, payload %d bytes", headerLen, payloadLen)
+	}
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r.br, header); err != nil {
+		return nil, nil, unexpectedEOF(err)
+	}
+	var payload []byte
+	if payloadLen > 0 {
+		payload = make([]byte, payloadLen)
+		if _, err := io.ReadFull(r.br, payload); err != nil {
+			return nil, nil, unexpectedEOF(err)
+		}
+	}
+	return header, payload, nil
+}
+
+// unexpectedEOF turns an EOF partway through a frame into an error, so
+// Serve doesn't mistake a truncated frame for a clean end of input.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+type frameWriter struct {
+	w io.Writer
+}
+
+func (w *frameWriter) writeMessage(v any, payload []byte) error {
+	header, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var prefix [8]byte
+	binary.BigEndian.PutUint32(prefix[0:4], uint32(len(header)))
+	binary.BigEndian.PutUint32(prefix[4:8], uint32(len(payload)))
+	bufs := net.Buffers{prefix[:], header, payload}
+	_, err = bufs.WriteTo(w.w)
+	return err
+}
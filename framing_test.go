@@ -0,0 +1,166 @@
+package fastagent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBinaryFraming(t *testing.T) {
+	s := newTestServer()
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := s.Serve(inR, outW)
+		outW.Close()
+		done <- err
+	}()
+	br := bufio.NewReader(outR)
+
+	// The handshake itself is NDJSON.
+	hello, _ := json.Marshal(Request{ID: 1, Method: "Hello", Params: json.RawMessage(`{"version":"test","framing":["zstd-frames","binary"]}`)})
+	if _, err := inW.Write(append(hello, '\n')); err != nil {
+		t.Fatal(err)
+	}
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var helloResp struct {
+		Result HelloResult `json:"result"`
+	}
+	if err := json.Unmarshal(line, &helloResp); err != nil {
+		t.Fatal(err)
+	}
+	if helloResp.Result.Framing != FramingBinary {
+		t.Fatalf("framing = %q, want %q", helloResp.Result.Framing, FramingBinary)
+	}
+
+	fw := newMessageWriter(FramingBinary, inW)
+	fr := newMessageReader(FramingBinary, br)
+	roundTrip := func(req Request, payload []byte) (Response, []byte) {
+		t.Helper()
+		if err := fw.writeMessage(req, payload); err != nil {
+			t.Fatal(err)
+		}
+		header, respPayload, err := fr.readMessage()
+		if err != nil {
+			t.Fatalf("reading frame: %v", err)
+		}
+		var resp Response
+		if err := json.Unmarshal(header, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Error != nil {
+			t.Fatalf("%s: %s", req.Method, resp.Error.Message)
+		}
+		return resp, respPayload
+	}
+
+	// Content that would break a line protocol without base64.
+	content := []byte("binary\x00data\nwith newlines\r\n\xff\xfe")
+	dest := filepath.Join(t.TempDir(), "out.bin")
+	roundTrip(Request{ID: 2, Method: "WriteFile", Params: json.RawMessage(`{"dest":"` + dest + `"}`)}, content)
+	got, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("written content = %q, want %q", got, content)
+	}
+
+	resp, payload := roundTrip(Request{ID: 3, Method: "ReadFile", Params: json.RawMessage(`{"path":"` + dest + `"}`)}, nil)
+	if !bytes.Equal(payload, content) {
+		t.Fatalf("ReadFile payload = %q, want %q", payload, content)
+	}
+	var rf ReadFileResult
+	data, _ := json.Marshal(resp.Result)
+	if err := json.Unmarshal(data, &rf); err != nil {
+		t.Fatal(err)
+	}
+	if rf.Content != "" || rf.Size != int64(len(content)) {
+		t.Errorf("ReadFile result = %+v, want empty content and size %d", rf, len(content))
+	}
+
+	// Requests without file content work the same as before.
+	roundTrip(Request{ID: 4, Method: "Stat", Params: json.RawMessage(`{"path":"` + dest + `"}`)}, nil)
+
+	inW.Close()
+	go io.Copy(io.Discard, br)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHelloWithoutFramingStaysNDJSON(t *testing.T) {
+	s := newTestServer()
+	send, recv, stop := serveConn(t, s)
+	defer stop()
+
+	send(Request{ID: 1, Method: "Hello", Params: json.RawMessage(`{"version":"test"}`)})
+	resp := recv()
+	if resp.Error != nil {
+		t.Fatal(resp.Error.Message)
+	}
+	data, _ := json.Marshal(resp.Result)
+	var hr HelloResult
+	if err := json.Unmarshal(data, &hr); err != nil {
+		t.Fatal(err)
+	}
+	if hr.Framing != FramingNDJSON {
+		t.Errorf("framing = %q, want %q", hr.Framing, FramingNDJSON)
+	}
+
+	// A following request is still read as a line.
+	send(Request{ID: 2, Method: "Stat", Params: json.RawMessage(`{"path":"/"}`)})
+	if resp := recv(); resp.ID != 2 || resp.Error != nil {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
+
+func TestLineReader(t *testing.T) {
+	in := "first\r\n\n\nsecond\n" + strings.Repeat("x", 200000) + "\nlast"
+	r := newMessageReader(FramingNDJSON, bufio.NewReaderSize(strings.NewReader(in), 16))
+	want := []string{"first", "second", strings.Repeat("x", 200000), "last"}
+	for _, w := range want {
+		got, payload, err := r.readMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != w || payload != nil {
+			t.Fatalf("got %.20q (payload %q), want %.20q", got, payload, w)
+		}
+	}
+	if _, _, err := r.readMessage(); !errors.Is(err, io.EOF) {
+		t.Fatalf("err = %v, want EOF", err)
+	}
+}
+
+func TestFrameReaderTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(10))
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+	buf.WriteString("{}")
+	r := newMessageReader(FramingBinary, bufio.NewReader(&buf))
+	if _, _, err := r.readMessage(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("err = %v, want ErrUnexpectedEOF", err)
+	}
+}
+
+func TestFrameReaderTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(2))
+	binary.Write(&buf, binary.BigEndian, uint32(maxMessageSize+1))
+	r := newMessageReader(FramingBinary, bufio.NewReader(&buf))
+	if _, _, err := r.readMessage(); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("err = %v, want too large", err)
+	}
+}
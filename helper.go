@@ -0,0 +1,161 @@
+package fastagent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// helperEnv marks a process started by runAsUser as a helper rather than
+// an agent.
+const helperEnv = "FASTAGENT_HELPER"
+
+// HelperMain runs this process as a privilege-dropped helper if it was
+// started as one, and exits. Otherwise it returns immediately. Programs
+// embedding the agent (and tests, from TestMain) must call it before doing
+// anything else, since runAsUser re-executes the running binary.
+func HelperMain() {
+	if os.Getenv(helperEnv) == "" {
+		return
+	}
+	os.Exit(runHelper(os.Stdin, os.Stdout))
+}
+
+// helperRequest is what runAsUser sends the helper on stdin. Binary and
+// Payload carry the request's framing state over, so content handling
+// works the same as in the agent.
+type helperRequest struct {
+	Credential syscall.Credential `json:"credential"`
+	Method     string             `json:"method"`
+	Params     json.RawMessage    `json:"params"`
+	Binary     bool               `json:"binary,omitempty"`
+	Payload    []byte             `json:"payload,omitempty"`
+}
+
+// helperResponse is what the helper writes back on stdout.
+type helperResponse struct {
+	Result  json.RawMessage `json:"result,omitempty"`
+	Payload []byte          `json:"payload,omitempty"`
+	Error   *ErrorInfo      `json:"error,omitempty"`
+}
+
+func runHelper(r io.Reader, w io.Writer) int {
+	enc := json.NewEncoder(w)
+	var req helperRequest
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		enc.Encode(helperResponse{Error: errorInfo(fmt.Errorf("helper: read request: %w", err))})
+		return 1
+	}
+	// Nothing may touch the filesystem before this.
+	if err := dropPrivileges(req.Credential); err != nil {
+		enc.Encode(helperResponse{Error: errorInfo(fmt.Errorf("helper: drop privileges: %w", err))})
+		return 1
+	}
+	m, ok := methods[req.Method]
+	if !ok {
+		enc.Encode(helperResponse{Error: &ErrorInfo{Code: CodeMethodNotFound, Message: "unknown method: " + req.Method}})
+		return 1
+	}
+
+	c := &call{binary: req.Binary, payload: req.Payload}
+	ctx := context.WithValue(context.Background(), callKey{}, c)
+	s := &Server{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	result, err := m.handle(s, ctx, req.Params)
+	if err != nil {
+		enc.Encode(helperResponse{Error: errorInfo(err)})
+		return 0
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		enc.Encode(helperResponse{Error: errorInfo(fmt.Errorf("helper: marshal result: %w", err))})
+		return 1
+	}
+	enc.Encode(helperResponse{Result: data, Payload: c.respPayload})
+	return 0
+}
+
+// runAsUser runs method, with params (which must not name a become user
+// again), as username: in a helper process that drops to the user's uid,
+// gid and supplementary groups before doing anything, so the operation
+// sees exactly the permissions the user has. No sudo is involved.
+//
+// When the agent already runs as username it calls the handler directly.
+func (s *Server) runAsUser(ctx context.Context, username, method string, params any) (any, error) {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("marshal %s params: %w", method, err)
+	}
+	cred, err := lookupCredential(username)
+	if err != nil {
+		return nil, err
+	}
+	if int(cred.Uid) == os.Geteuid() {
+		return methods[method].handle(s, ctx, raw)
+	}
+	if os.Geteuid() != 0 {
+		return nil, newError(CodePermissionDenied, &ErrorData{Param: "become_user"},
+			"become_user %q: the agent must run as root to act as another user", username)
+	}
+
+	req := helperRequest{Credential: *cred, Method: method, Params: raw}
+	c := callFromContext(ctx)
+	if c != nil {
+		req.Binary = c.binary
+		req.Payload = c.payload
+	}
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal helper request: %w", err)
+	}
+
+	exe, err := helperExecutable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := commandContext(ctx, exe)
+	cmd.Env = append(os.Environ(), helperEnv+"=1")
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	runErr := cmd.Run()
+
+	var resp helperResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		if runErr != nil {
+			err = runErr
+		}
+		return nil, fmt.Errorf("%s as %s: helper failed: %w: %s", method, username, err, strings.TrimSpace(stderr.String()))
+	}
+	if resp.Error != nil {
+		return nil, &Error{Code: resp.Error.Code, Data: resp.Error.Data, Err: errors.New(resp.Error.Message)}
+	}
+	if c != nil && resp.Payload != nil {
+		c.respPayload = resp.Payload
+	}
+	return resp.Result, nil
+}
+
+// helperExecutable returns a path to the running binary. On Linux
+// /proc/self/exe keeps working after the binary is replaced on disk, as
+// it is on every upgrade.
+func helperExecutable() (string, error) {
+	if runtime.GOOS == "linux" {
+		if _, err := os.Stat("/proc/self/exe"); err == nil {
+			return "/proc/self/exe", nil
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("find helper executable: %w", err)
+	}
+	return exe, nil
+}
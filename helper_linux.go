@@ -0,0 +1,20 @@
+package fastagent
+
+import "syscall"
+
+// dropPrivileges permanently switches every thread of the process to
+// cred: supplementary groups first, then real, effective and saved gid,
+// then uid, after which there's no way back to root.
+func dropPrivileges(cred syscall.Credential) error {
+	groups := make([]int, len(cred.Groups))
+	for i, g := range cred.Groups {
+		groups[i] = int(g)
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return err
+	}
+	if err := syscall.Setresgid(int(cred.Gid), int(cred.Gid), int(cred.Gid)); err != nil {
+		return err
+	}
+	return syscall.Setresuid(int(cred.Uid), int(cred.Uid), int(cred.Uid))
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package fastagent
+
+import "syscall"
+
+// dropPrivileges permanently switches the process to cred. Without
+// setresuid, setreuid as root sets the saved uid too.
+func dropPrivileges(cred syscall.Credential) error {
+	groups := make([]int, len(cred.Groups))
+	for i, g := range cred.Groups {
+		groups[i] = int(g)
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return err
+	}
+	if err := syscall.Setregid(int(cred.Gid), int(cred.Gid)); err != nil {
+		return err
+	}
+	return syscall.Setreuid(int(cred.Uid), int(cred.Uid))
+}
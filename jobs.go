@@ -0,0 +1,309 @@
+package fastagent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jobTable tracks background Exec jobs started with JobStart. It belongs
+// to the Server rather than a connection, so a job keeps running (and its
+// result stays available) after the connection that submitted it closes.
+// That is the point of `async:` tasks: fire off a reboot or a long
+// upgrade, disconnect, and poll later.
+type jobTable struct {
+	dir string
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+type job struct {
+	id     string
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// status is written once, by the goroutine running the job, before
+	// done is closed.
+	status JobStatusResult
+}
+
+// jobTable returns the server's job table, creating it on first use.
+func (s *Server) jobTable() *jobTable {
+	s.jobsOnce.Do(func() {
+		dir := s.JobDir
+		if dir == "" {
+			// Same default as Ansible's async_dir, so a result
+			// file left behind by a job can be read by stock
+			// async_status too.
+			home, err := os.UserHomeDir()
+			if err != nil {
+				home = os.TempDir()
+			}
+			dir = filepath.Join(home, ".ansible_async")
+		}
+		s.jobs = &jobTable{dir: dir, jobs: make(map[string]*job)}
+	})
+	return s.jobs
+}
+
+// running reports how many jobs have not finished yet.
+func (t *jobTable) running() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, j := range t.jobs {
+		select {
+		case <-j.done:
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// runningJobs reports how many background jobs the server is running. The
+// daemon doesn't idle out while this is non-zero.
+func (s *Server) runningJobs() int {
+	return s.jobTable().running()
+}
+
+func (t *jobTable) resultsFile(id string) string {
+	return filepath.Join(t.dir, id)
+}
+
+// writeStatus persists st atomically, so a concurrent reader never sees a
+// half-written file.
+func (t *jobTable) writeStatus(st JobStatusResult) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(t.dir, ".fastagent-job-*")
+	if err != nil {
+		return fmt.Errorf("create temp: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write temp: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("close temp: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), st.ResultsFile); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("rename temp to %s: %w", st.ResultsFile, err)
+	}
+	return nil
+}
+
+// lookup returns the in-memory job, or (when this daemon didn't start it,
+// e.g. an earlier daemon that idled out) the status persisted on disk.
+func (t *jobTable) lookup(id string) (*job, *JobStatusResult, error) {
+	if err := validJobID(id); err != nil {
+		return nil, nil, err
+	}
+	t.mu.Lock()
+	j := t.jobs[id]
+	t.mu.Unlock()
+	if j != nil {
+		return j, nil, nil
+	}
+	data, err := os.ReadFile(t.resultsFile(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, newError(CodeNotFound, nil, "could not find job %q", id)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("read job %s: %w", id, err)
+	}
+	var st JobStatusResult
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, nil, fmt.Errorf("parse job %s: %w", id, err)
+	}
+	return nil, &st, nil
+}
+
+// current returns a job's status: the final one if it has finished, or a
+// started-but-not-finished placeholder.
+func (j *job) current(resultsFile string) JobStatusResult {
+	select {
+	case <-j.done:
+		return j.status
+	default:
+		return JobStatusResult{JobID: j.id, Started: 1, Finished: 0, ResultsFile: resultsFile}
+	}
+}
+
+func validJobID(id string) error {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, "/\x00") {
+		return invalidParams("invalid job id %q", id)
+	}
+	return nil
+}
+
+func newJobID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return "fastagent-" + hex.EncodeToString(b[:])
+}
+
+func (s *Server) handleJobStart(ctx context.Context, params json.RawMessage) (any, error) {
+	var p JobStartParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, invalidParams("unmarshal JobStartParams: %w", err)
+	}
+	if p.JobID == "" {
+		p.JobID = newJobID()
+	}
+	if err := validJobID(p.JobID); err != nil {
+		return nil, err
+	}
+	execParams, err := json.Marshal(p.Exec)
+	if err != nil {
+		return nil, fmt.Errorf("marshal exec params: %w", err)
+	}
+
+	t := s.jobTable()
+	if err := os.MkdirAll(t.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("mkdir %s: %w", t.dir, err)
+	}
+	resultsFile := t.resultsFile(p.JobID)
+
+	// The job must not inherit the request's context: cancelling or
+	// closing the submitting connection is exactly what async jobs are
+	// meant to survive. JobKill is the only way to stop one early.
+	jobCtx, cancel := context.WithCancel(context.Background())
+	j := &job{id: p.JobID, cancel: cancel, done: make(chan struct{})}
+	t.mu.Lock()
+	if _, ok := t.jobs[p.JobID]; ok {
+		t.mu.Unlock()
+		cancel()
+		return nil, newError(CodeConflict, nil, "job %q already exists", p.JobID)
+	}
+	t.jobs[p.JobID] = j
+	t.mu.Unlock()
+
+	started := j.current(resultsFile)
+	if err := t.writeStatus(started); err != nil {
+		t.mu.Lock()
+		delete(t.jobs, p.JobID)
+		t.mu.Unlock()
+		cancel()
+		return nil, err
+	}
+
+	s.Logger.Info("job started", "job", p.JobID)
+	go func() {
+		defer cancel()
+		st := JobStatusResult{JobID: p.JobID, Started: 1, Finished: 1, ResultsFile: resultsFile}
+		result, err := s.handleExec(jobCtx, execParams)
+		if err != nil {
+			st.Failed = true
+			st.ExecResult = &ExecResult{Msg: err.Error()}
+		} else {
+			r := result.(ExecResult)
+			st.ExecResult = &r
+		}
+		if err := t.writeStatus(st); err != nil {
+			s.Logger.Error("failed to persist job result", "job", p.JobID, "error", err)
+		}
+		j.status = st
+		close(j.done)
+		s.Logger.Info("job finished", "job", p.JobID, "failed", st.Failed)
+	}()
+
+	return started, nil
+}
+
+func (s *Server) handleJobStatus(ctx context.Context, params json.RawMessage) (any, error) {
+	var p JobStatusParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, invalidParams("unmarshal JobStatusParams: %w", err)
+	}
+	t := s.jobTable()
+	j, persisted, err := t.lookup(p.JobID)
+	if err != nil {
+		return nil, err
+	}
+	st := persisted
+	if j != nil {
+		cur := j.current(t.resultsFile(p.JobID))
+		st = &cur
+	}
+	if p.Cleanup {
+		// Matches async_status mode=cleanup: forget the result, but
+		// leave a job that's still running alone.
+		if st.Finished == 0 {
+			return nil, newError(CodeConflict, nil, "job %q is still running", p.JobID)
+		}
+		if err := os.Remove(t.resultsFile(p.JobID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("remove %s: %w", t.resultsFile(p.JobID), err)
+		}
+		t.mu.Lock()
+		delete(t.jobs, p.JobID)
+		t.mu.Unlock()
+	}
+	return *st, nil
+}
+
+func (s *Server) handleJobWait(ctx context.Context, params json.RawMessage) (any, error) {
+	var p JobWaitParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, invalidParams("unmarshal JobWaitParams: %w", err)
+	}
+	t := s.jobTable()
+	j, persisted, err := t.lookup(p.JobID)
+	if err != nil {
+		return nil, err
+	}
+	if j == nil {
+		return *persisted, nil
+	}
+
+	var timeout <-chan time.Time
+	if p.TimeoutSeconds > 0 {
+		timer := time.NewTimer(time.Duration(p.TimeoutSeconds) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-j.done:
+	case <-timeout:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return j.current(t.resultsFile(p.JobID)), nil
+}
+
+func (s *Server) handleJobKill(ctx context.Context, params json.RawMessage) (any, error) {
+	var p JobKillParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, invalidParams("unmarshal JobKillParams: %w", err)
+	}
+	t := s.jobTable()
+	j, persisted, err := t.lookup(p.JobID)
+	if err != nil {
+		return nil, err
+	}
+	if j == nil {
+		return *persisted, nil
+	}
+	j.cancel()
+	select {
+	case <-j.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	s.Logger.Info("job killed", "job", p.JobID)
+	return j.current(t.resultsFile(p.JobID)), nil
+}
@@ -0,0 +1,140 @@
+package fastagent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newJobTestServer(t *testing.T) *Server {
+	t.Helper()
+	s := newTestServer()
+	s.JobDir = t.TempDir()
+	return s
+}
+
+func decodeJobStatus(t *testing.T, resp Response) JobStatusResult {
+	t.Helper()
+	if resp.Error != nil {
+		t.Fatalf("unexpected error: %v", resp.Error)
+	}
+	resultJSON, _ := json.Marshal(resp.Result)
+	var st JobStatusResult
+	if err := json.Unmarshal(resultJSON, &st); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestJobStartAndWait(t *testing.T) {
+	s := newJobTestServer(t)
+
+	st := decodeJobStatus(t, rpcCall(t, s, "JobStart", JobStartParams{
+		JobID: "123.456",
+		Exec:  ExecParams{CmdString: "echo done; exit 3", UseShell: true},
+	}))
+	if st.JobID != "123.456" || st.Started != 1 {
+		t.Fatalf("JobStart returned %+v", st)
+	}
+	if st.ResultsFile != filepath.Join(s.JobDir, "123.456") {
+		t.Errorf("results_file = %q, want it under JobDir", st.ResultsFile)
+	}
+
+	st = decodeJobStatus(t, rpcCall(t, s, "JobWait", JobWaitParams{JobID: "123.456", TimeoutSeconds: 10}))
+	if st.Finished != 1 {
+		t.Fatalf("job not finished after JobWait: %+v", st)
+	}
+	if st.ExecResult == nil || st.RC != 3 || st.Stdout != "done" {
+		t.Errorf("job result = %+v, want rc=3 stdout=done", st.ExecResult)
+	}
+
+	// The persisted file is what async_status reads.
+	data, err := os.ReadFile(st.ResultsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var persisted map[string]any
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		t.Fatal(err)
+	}
+	if persisted["finished"] != float64(1) || persisted["rc"] != float64(3) {
+		t.Errorf("persisted result = %s", data)
+	}
+}
+
+// TestJobOutlivesConnection starts a job on one connection and polls it
+// from another, the way async/poll tasks use separate RPC sessions.
+func TestJobOutlivesConnection(t *testing.T) {
+	s := newJobTestServer(t)
+
+	marker := filepath.Join(t.TempDir(), "marker")
+	decodeJobStatus(t, rpcCall(t, s, "JobStart", JobStartParams{
+		JobID: "outlive",
+		Exec:  ExecParams{CmdString: "sleep 0.3; touch " + marker, UseShell: true},
+	}))
+
+	st := decodeJobStatus(t, rpcCall(t, s, "JobStatus", JobStatusParams{JobID: "outlive"}))
+	if st.Finished != 0 {
+		t.Fatalf("job finished too early: %+v", st)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for st.Finished == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		st = decodeJobStatus(t, rpcCall(t, s, "JobStatus", JobStatusParams{JobID: "outlive"}))
+	}
+	if st.Finished != 1 {
+		t.Fatal("job did not finish")
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("job did not run to completion: %v", err)
+	}
+}
+
+func TestJobKill(t *testing.T) {
+	s := newJobTestServer(t)
+
+	decodeJobStatus(t, rpcCall(t, s, "JobStart", JobStartParams{
+		JobID: "kill-me",
+		Exec:  ExecParams{Argv: []string{"sleep", "30"}},
+	}))
+	start := time.Now()
+	st := decodeJobStatus(t, rpcCall(t, s, "JobKill", JobKillParams{JobID: "kill-me"}))
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("JobKill took too long")
+	}
+	if st.Finished != 1 || !st.Failed {
+		t.Errorf("killed job status = %+v, want finished and failed", st)
+	}
+	if s.runningJobs() != 0 {
+		t.Errorf("runningJobs = %d after kill, want 0", s.runningJobs())
+	}
+}
+
+// TestJobStatusFromDisk covers a job started by an earlier daemon: only
+// its result file is left.
+func TestJobStatusFromDisk(t *testing.T) {
+	s := newJobTestServer(t)
+	path := filepath.Join(s.JobDir, "old")
+	if err := os.WriteFile(path, []byte(`{"ansible_job_id":"old","started":1,"finished":1,"rc":0,"stdout":"hi"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	st := decodeJobStatus(t, rpcCall(t, s, "JobStatus", JobStatusParams{JobID: "old", Cleanup: true}))
+	if st.Finished != 1 || st.ExecResult == nil || st.Stdout != "hi" {
+		t.Errorf("status from disk = %+v", st)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("cleanup left %s behind: %v", path, err)
+	}
+}
+
+func TestJobRejectsUnsafeID(t *testing.T) {
+	s := newJobTestServer(t)
+	resp := rpcCall(t, s, "JobStatus", JobStatusParams{JobID: "../etc/passwd"})
+	if resp.Error == nil {
+		t.Fatal("expected error for a job id containing a slash")
+	}
+}
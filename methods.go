@@ -0,0 +1,126 @@
+package fastagent
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Protocol versions. The protocol version is separate from Version: it
+// only changes when the wire protocol does in a way an older peer can't
+// cope with, while Version changes with every release. A controller that
+// doesn't send a range is assumed to speak only version 1.
+const (
+	MinProtocolVersion = 1
+	MaxProtocolVersion = 1
+)
+
+// handlerFunc is the signature of every RPC handler.
+type handlerFunc func(s *Server, ctx context.Context, params json.RawMessage) (any, error)
+
+// method is one entry in the registry of RPCs: its handler, and what Hello
+// tells controllers about it.
+type method struct {
+	handle handlerFunc
+	// params is the method's params struct, whose JSON fields are
+	// advertised as supported, less any in unsupported (params that are
+	// decoded but rejected).
+	params      any
+	unsupported []string
+	// info holds the rest of what Hello reports; Params is filled in
+	// from params.
+	info MethodInfo
+}
+
+// methods maps method names to their registry entries. It's filled in by
+// init because handleBatch reaches back into it through dispatch.
+var methods map[string]method
+
+func init() {
+	methods = map[string]method{
+		"Hello":  {handle: (*Server).handleHello, params: HelloParams{}},
+		"Cancel": {handle: (*Server).handleCancel, params: CancelParams{}},
+		"Batch":  {handle: (*Server).handleBatch, params: BatchParams{}},
+		"Exec":   {handle: (*Server).handleExec, params: ExecParams{}},
+		"Stat": {
+			handle: (*Server).handleStat,
+			params: StatParams{},
+			info:   MethodInfo{ChecksumAlgorithms: checksumAlgorithms},
+		},
+		"ReadFile": {handle: (*Server).handleReadFile, params: ReadFileParams{}},
+		"WriteFile": {
+			handle:      (*Server).handleWriteFile,
+			params:      WriteFileParams{},
+			unsupported: []string{"validate"},
+		},
+		"WriteFileBegin": {
+			handle:      (*Server).handleWriteFileBegin,
+			params:      WriteFileBeginParams{},
+			unsupported: []string{"validate", "become_user"},
+		},
+		"WriteFileChunk":  {handle: (*Server).handleWriteFileChunk, params: WriteFileChunkParams{}},
+		"WriteFileCommit": {handle: (*Server).handleWriteFileCommit, params: WriteFileCommitParams{}},
+		"WriteFileAbort":  {handle: (*Server).handleWriteFileAbort, params: WriteFileAbortParams{}},
+		"ReadFileChunk":   {handle: (*Server).handleReadFileChunk, params: ReadFileChunkParams{}},
+		"File": {
+			handle: (*Server).handleFile,
+			params: FileParams{},
+			info:   MethodInfo{States: fileStates},
+		},
+		"JobStart":  {handle: (*Server).handleJobStart, params: JobStartParams{}},
+		"JobStatus": {handle: (*Server).handleJobStatus, params: JobStatusParams{}},
+		"JobWait":   {handle: (*Server).handleJobWait, params: JobWaitParams{}},
+		"JobKill":   {handle: (*Server).handleJobKill, params: JobKillParams{}},
+		"Package": {
+			handle: (*Server).handlePackage,
+			params: PackageParams{},
+			info:   MethodInfo{States: packageStates, Managers: packageManagers},
+		},
+		"Service": {
+			handle: (*Server).handleService,
+			params: ServiceParams{},
+			info:   MethodInfo{States: serviceStates, Managers: serviceManagers},
+		},
+	}
+}
+
+// methodInfos describes every registered method for HelloResult.Methods.
+func methodInfos() map[string]MethodInfo {
+	infos := make(map[string]MethodInfo, len(methods))
+	for name, m := range methods {
+		info := m.info
+		for _, p := range paramNames(reflect.TypeOf(m.params)) {
+			if !slices.Contains(m.unsupported, p) {
+				info.Params = append(info.Params, p)
+			}
+		}
+		infos[name] = info
+	}
+	return infos
+}
+
+// paramNames returns the JSON field names of struct type t, including
+// those of embedded structs, in declaration order.
+func paramNames(t reflect.Type) []string {
+	var names []string
+	for f := range t.Fields() {
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			names = append(names, paramNames(f.Type)...)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
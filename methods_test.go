@@ -0,0 +1,82 @@
+package fastagent
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestHelloMethods(t *testing.T) {
+	s := newTestServer()
+	var result HelloResult
+	decodeResult(t, rpcCall(t, s, "Hello", HelloParams{Version: "test"}), &result)
+
+	if result.Protocol != MaxProtocolVersion {
+		t.Errorf("protocol = %d, want %d", result.Protocol, MaxProtocolVersion)
+	}
+	if len(result.Methods) != len(methods) {
+		t.Errorf("Hello describes %d methods, want %d", len(result.Methods), len(methods))
+	}
+	stat, ok := result.Methods["Stat"]
+	if !ok {
+		t.Fatal("no Stat in methods")
+	}
+	if !slices.Contains(stat.Params, "checksum_algorithm") {
+		t.Errorf("Stat params %v lack checksum_algorithm", stat.Params)
+	}
+	if slices.Contains(stat.Params, "become_user") {
+		t.Errorf("Stat params %v advertise unsupported become_user", stat.Params)
+	}
+	if !slices.Contains(stat.ChecksumAlgorithms, "sha256") {
+		t.Errorf("Stat checksum algorithms = %v", stat.ChecksumAlgorithms)
+	}
+	// Embedded params structs contribute their fields.
+	if begin := result.Methods["WriteFileBegin"]; !slices.Contains(begin.Params, "dest") || !slices.Contains(begin.Params, "sha256") {
+		t.Errorf("WriteFileBegin params = %v", begin.Params)
+	}
+	if pkg := result.Methods["Package"]; !slices.Contains(pkg.Managers, "apt") {
+		t.Errorf("Package managers = %v", pkg.Managers)
+	}
+}
+
+func TestNegotiateProtocol(t *testing.T) {
+	tests := []struct {
+		min, max int
+		want     int
+		wantErr  bool
+	}{
+		{0, 0, 1, false},
+		{1, 1, 1, false},
+		{1, MaxProtocolVersion + 5, MaxProtocolVersion, false},
+		{MaxProtocolVersion + 1, MaxProtocolVersion + 2, 0, true},
+		{3, 2, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := negotiateProtocol(HelloParams{ProtocolMin: tt.min, ProtocolMax: tt.max})
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("negotiateProtocol(%d, %d) = %d, %v; want %d, error %v", tt.min, tt.max, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestHelloIncompatibleProtocol(t *testing.T) {
+	s := newTestServer()
+	resp := rpcCall(t, s, "Hello", HelloParams{Version: "test", ProtocolMin: MaxProtocolVersion + 1, ProtocolMax: MaxProtocolVersion + 1})
+	if resp.Error == nil {
+		t.Fatal("expected Hello to refuse an incompatible controller")
+	}
+}
+
+// The advertised algorithms have to be the ones digestFile accepts.
+func TestChecksumAlgorithmsSupported(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, alg := range checksumAlgorithms {
+		if _, err := digestFile(path, alg); err != nil {
+			t.Errorf("digestFile(%q): %v", alg, err)
+		}
+	}
+}
@@ -2,10 +2,9 @@ package fastagent
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
-	"fmt"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
@@ -142,10 +141,16 @@ func loadInstalledPackages(logger interface{ Debug(string, ...any) }) {
 	logger.Debug("loaded dpkg package cache", "count", len(pkgs))
 }
 
-func (s *Server) handlePackage(params json.RawMessage) (any, error) {
+// packageManagers and packageStates are what handlePackage accepts.
+var (
+	packageManagers = []string{"apt", "dnf", "yum"}
+	packageStates   = []string{"present", "absent", "latest"}
+)
+
+func (s *Server) handlePackage(ctx context.Context, params json.RawMessage) (any, error) {
 	var p PackageParams
 	if err := json.Unmarshal(params, &p); err != nil {
-		return nil, fmt.Errorf("unmarshal PackageParams: %w", err)
+		return nil, invalidParams("unmarshal PackageParams: %w", err)
 	}
 	if p.State == "" {
 		p.State = "present"
@@ -153,15 +158,15 @@ func (s *Server) handlePackage(params json.RawMessage) (any, error) {
 
 	switch p.Manager {
 	case "apt":
-		return s.handlePackageApt(p)
+		return s.handlePackageApt(ctx, p)
 	case "dnf", "yum":
-		return s.handlePackageDnf(p)
+		return s.handlePackageDnf(ctx, p)
 	default:
-		return nil, fmt.Errorf("unsupported package manager: %q", p.Manager)
+		return nil, unsupported("manager", "unsupported package manager: %q", p.Manager)
 	}
 }
 
-func (s *Server) handlePackageApt(p PackageParams) (any, error) {
+func (s *Server) handlePackageApt(ctx context.Context, p PackageParams) (any, error) {
 	cacheUpdated := false
 
 	if p.UpdateCache {
@@ -206,11 +211,11 @@ func (s *Server) handlePackageApt(p PackageParams) (any, error) {
 
 		if !skip {
 			s.Logger.Debug("running apt-get update")
-			cmd := exec.Command("apt-get", aptGetArgs("update")...)
+			cmd := commandContext(ctx, "apt-get", aptGetArgs("update")...)
 			cmd.Env = append(cmd.Environ(), "DEBIAN_FRONTEND=noninteractive")
 			out, err := cmd.CombinedOutput()
 			if err != nil {
-				return nil, fmt.Errorf("apt-get update: %s\n%s", err, string(out))
+				return nil, commandError("apt-get update", cmd, out, err)
 			}
 			aptMu.Lock()
 			aptCacheUpdated = time.Now()
@@ -267,14 +272,14 @@ func (s *Server) handlePackageApt(p PackageParams) (any, error) {
 	case "latest":
 		args = append([]string{"install", "--yes", "--upgrade"}, p.Names...)
 	default:
-		return nil, fmt.Errorf("unsupported state %q for apt", p.State)
+		return nil, unsupported("state", "unsupported state %q for apt", p.State)
 	}
 
-	cmd := exec.Command("apt-get", aptGetArgs(args...)...)
+	cmd := commandContext(ctx, "apt-get", aptGetArgs(args...)...)
 	cmd.Env = append(cmd.Environ(), "DEBIAN_FRONTEND=noninteractive")
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return nil, fmt.Errorf("apt-get %s: %s\n%s", args[0], err, string(out))
+		return nil, commandError("apt-get "+args[0], cmd, out, err)
 	}
 
 	// Detect whether anything actually changed.
@@ -295,7 +300,7 @@ func (s *Server) handlePackageApt(p PackageParams) (any, error) {
 	}, nil
 }
 
-func (s *Server) handlePackageDnf(p PackageParams) (any, error) {
+func (s *Server) handlePackageDnf(ctx context.Context, p PackageParams) (any, error) {
 	manager := p.Manager
 	if manager == "" {
 		manager = "dnf"
@@ -310,13 +315,13 @@ func (s *Server) handlePackageDnf(p PackageParams) (any, error) {
 	case "latest":
 		args = append([]string{"install", "-y", "--best"}, p.Names...)
 	default:
-		return nil, fmt.Errorf("unsupported state %q for %s", p.State, manager)
+		return nil, unsupported("state", "unsupported state %q for %s", p.State, manager)
 	}
 
-	cmd := exec.Command(manager, args...)
+	cmd := commandContext(ctx, manager, args...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return nil, fmt.Errorf("%s %s: %s\n%s", manager, args[0], err, string(out))
+		return nil, commandError(manager+" "+args[0], cmd, out, err)
 	}
 
 	changed := !strings.Contains(string(out), "Nothing to do")
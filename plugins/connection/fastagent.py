@@ -158,6 +158,7 @@ from ansible.utils.display import Display
 from ansible.module_utils.common.text.converters import to_bytes
 
 from ansible_collections.kevinburke.fastagent.plugins.module_utils.fastagent_client import (
+    CODE_NOT_FOUND,
     FastAgentClient,
     FastAgentError,
 )
@@ -697,7 +698,11 @@ class Connection(ConnectionBase):
 
         try:
             result = self._agent_client.read_file(in_path)
-        except (FastAgentError, IOError) as e:
+        except FastAgentError as e:
+            if e.code == CODE_NOT_FOUND:
+                raise AnsibleFileNotFound(f"file not found: {in_path}")
+            raise AnsibleConnectionFailure(f"fastagent fetch_file failed: {e}")
+        except IOError as e:
             raise AnsibleConnectionFailure(f"fastagent fetch_file failed: {e}")
 
         data = base64.b64decode(result["content"])
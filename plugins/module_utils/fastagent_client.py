@@ -1,15 +1,20 @@
 """Shared JSON-RPC client for communicating with the fastagent Go binary.
 
 The client speaks newline-delimited JSON over stdin/stdout of a subprocess
-(typically an SSH session running the agent).
+(typically an SSH session running the agent). Hello can switch the
+connection to binary framing, where file content travels as raw bytes
+instead of base64, and to gzip compression.
 """
 
 from __future__ import annotations
 
+import base64
 import json
 import os
+import struct
 import threading
 import time as _time
+import zlib
 
 # When FASTAGENT_TRACE is set, each RPC is appended to this file as TSV:
 #   timestamp_ns \t method \t duration_ms \t hint
@@ -49,12 +54,32 @@ def _trace(method: str, duration_ns: int, hint: str) -> None:
         pass
 
 
+# Error codes in FastAgentError.code; see errors.go in the agent.
+CODE_PARSE_ERROR = -32700
+CODE_METHOD_NOT_FOUND = -32601
+CODE_INVALID_PARAMS = -32602
+CODE_CANCELLED = -32800
+CODE_FAILED = 1
+CODE_NOT_FOUND = 2
+CODE_PERMISSION_DENIED = 3
+CODE_UNSUPPORTED = 4
+CODE_TIMEOUT = 5
+CODE_CONFLICT = 6
+CODE_COMMAND_FAILED = 7
+
+
 class FastAgentError(Exception):
-    """Raised when the agent returns an error response."""
+    """Raised when the agent returns an error response.
+
+    code is one of the CODE_* constants. data, when present, is a dict of
+    structured detail: errno, path, param (the offending parameter for
+    CODE_UNSUPPORTED), and cmd/rc/stdout/stderr for CODE_COMMAND_FAILED.
+    """
 
-    def __init__(self, code: int, message: str):
+    def __init__(self, code: int, message: str, data: dict | None = None):
         self.code = code
         self.message = message
+        self.data = data or {}
         super().__init__(f"fastagent error {code}: {message}")
 
 
@@ -76,6 +101,57 @@ class FastAgentVersionMismatch(Exception):
         )
 
 
+# The range of agent protocol versions this client speaks. Hello fails if
+# the agent shares none of them.
+PROTOCOL_MIN = 1
+PROTOCOL_MAX = 1
+
+# Matches the agent's maxBlockSize: the most uncompressed content one
+# compression block may carry.
+_MAX_BLOCK_SIZE = 1 << 20
+_BLOCK_RAW = 0
+_BLOCK_GZIP = 1
+
+
+class _BlockReader:
+    """Reads the content of the agent's compression blocks as one stream."""
+
+    def __init__(self, raw):
+        self._raw = raw
+        self._buf = b""
+
+    def _fill(self) -> bool:
+        prefix = self._raw.read(5)
+        if not prefix:
+            return False
+        if len(prefix) != 5:
+            raise IOError("fastagent: truncated compression block")
+        kind, length = struct.unpack(">BI", prefix)
+        data = self._raw.read(length) if length else b""
+        if len(data) != length:
+            raise IOError("fastagent: truncated compression block")
+        if kind == _BLOCK_GZIP:
+            data = zlib.decompress(data, wbits=31)
+        elif kind != _BLOCK_RAW:
+            raise IOError(f"fastagent: unknown compression block kind {kind}")
+        self._buf += data
+        return True
+
+    def read(self, n: int) -> bytes:
+        while len(self._buf) < n and self._fill():
+            pass
+        data, self._buf = self._buf[:n], self._buf[n:]
+        return data
+
+    def readline(self) -> bytes:
+        while b"\n" not in self._buf and self._fill():
+            pass
+        i = self._buf.find(b"\n")
+        end = len(self._buf) if i < 0 else i + 1
+        data, self._buf = self._buf[:end], self._buf[end:]
+        return data
+
+
 class FastAgentClient:
     """JSON-RPC client for fastagent.
 
@@ -83,17 +159,64 @@ class FastAgentClient:
     on the request ID counter and I/O.
     """
 
-    def __init__(self, stdin, stdout):
+    def __init__(self, stdin, stdout, on_notification=None):
         """Initialize with file-like objects for the agent's stdin and stdout.
 
         Args:
             stdin: writable file-like object (agent's stdin)
             stdout: readable file-like object (agent's stdout)
+            on_notification: optional callable(method, params) invoked for
+                each notification (e.g. ExecOutput from a streaming Exec)
+                the agent sends while a call is outstanding
         """
         self._stdin = stdin
         self._stdout = stdout
         self._next_id = 1
         self._lock = threading.Lock()
+        self._on_notification = on_notification
+        self._binary = False
+        self._reader = stdout
+        # Minimum block size to compress, or None when compression is off.
+        self._compress_min = None
+
+    def _send(self, message: dict, payload: bytes) -> None:
+        header = json.dumps(message, separators=(",", ":")).encode("utf-8")
+        if self._binary:
+            data = struct.pack(">II", len(header), len(payload)) + header + payload
+        else:
+            data = header + b"\n"
+        if self._compress_min is None:
+            self._stdin.write(data)
+        else:
+            for i in range(0, len(data), _MAX_BLOCK_SIZE):
+                self._write_block(data[i:i + _MAX_BLOCK_SIZE])
+        self._stdin.flush()
+
+    def _write_block(self, data: bytes) -> None:
+        kind = _BLOCK_RAW
+        if len(data) >= self._compress_min:
+            c = zlib.compressobj(1, zlib.DEFLATED, 31)
+            compressed = c.compress(data) + c.flush()
+            if len(compressed) < len(data):
+                kind, data = _BLOCK_GZIP, compressed
+        self._stdin.write(struct.pack(">BI", kind, len(data)))
+        self._stdin.write(data)
+
+    def _read_exact(self, n: int) -> bytes:
+        data = self._reader.read(n) if n else b""
+        if len(data) != n:
+            raise IOError("fastagent: no response (agent process may have exited)")
+        return data
+
+    def _receive(self) -> tuple[dict, bytes]:
+        if self._binary:
+            header_len, payload_len = struct.unpack(">II", self._read_exact(8))
+            header = self._read_exact(header_len)
+            return json.loads(header), self._read_exact(payload_len)
+        line = self._reader.readline()
+        if not line:
+            raise IOError("fastagent: no response (agent process may have exited)")
+        return json.loads(line), b""
 
     def call(self, method: str, params: dict | None = None) -> dict:
         """Send a JSON-RPC request and return the result.
@@ -109,6 +232,18 @@ class FastAgentClient:
             FastAgentError: if the agent returns an error response.
             IOError: if communication with the agent fails.
         """
+        return self.call_with_payload(method, params)[0]
+
+    def call_with_payload(
+        self, method: str, params: dict | None = None, payload: bytes = b""
+    ) -> tuple[dict, bytes]:
+        """Like call, but with a raw payload in each direction.
+
+        Payloads only exist in binary framing; with NDJSON the request
+        payload must be empty and the returned one always is.
+        """
+        if payload and not self._binary:
+            raise ValueError("fastagent: payload requires binary framing")
         with self._lock:
             req_id = self._next_id
             self._next_id += 1
@@ -119,22 +254,22 @@ class FastAgentClient:
                 "params": params or {},
             }
 
-            line = json.dumps(request, separators=(",", ":")) + "\n"
             start_ns = _time.monotonic_ns() if _TRACE_PATH else 0
-            self._stdin.write(line.encode("utf-8"))
-            self._stdin.flush()
-
-            response_line = self._stdout.readline()
-            if not response_line:
-                raise IOError(
-                    "fastagent: no response (agent process may have exited)"
-                )
+            self._send(request, payload)
+
+            while True:
+                response, response_payload = self._receive()
+                # Notifications carry a method and no id; they arrive
+                # ahead of the response to the call that produced them.
+                if "method" in response and "id" not in response:
+                    if self._on_notification is not None:
+                        self._on_notification(response["method"], response.get("params"))
+                    continue
+                break
 
             if _TRACE_PATH:
                 _trace(method, _time.monotonic_ns() - start_ns, _trace_hint(method, params))
 
-            response = json.loads(response_line)
-
             if response.get("id") != req_id:
                 raise IOError(
                     f"fastagent: response id mismatch: "
@@ -143,23 +278,74 @@ class FastAgentClient:
 
             if "error" in response and response["error"] is not None:
                 err = response["error"]
-                raise FastAgentError(err.get("code", 1), err.get("message", "unknown error"))
+                raise FastAgentError(
+                    err.get("code", CODE_FAILED),
+                    err.get("message", "unknown error"),
+                    err.get("data"),
+                )
 
-            return response.get("result", {})
+            return response.get("result", {}), response_payload
 
-    def hello(self, version: str = "0.1.0") -> dict:
+    def hello(
+        self,
+        version: str = "0.1.0",
+        binary: bool = False,
+        compress: bool = False,
+        compress_min_size: int = 512,
+    ) -> dict:
         """Send Hello handshake and verify the daemon's version matches.
 
         Raises FastAgentVersionMismatch if the daemon reports a different
         version. The caller is expected to tear down the connection and
         bootstrap a fresh daemon at the matching version.
+
+        If binary is set, ask the agent to switch to binary framing; the
+        client follows whatever the agent agrees to. read_file and
+        write_file keep taking and returning base64, but the bytes on the
+        wire are raw.
+
+        If compress is set, ask for gzip compression of blocks of at least
+        compress_min_size bytes in both directions. It's worth it on slow
+        links; on a local socket it only costs CPU.
         """
-        result = self.call("Hello", {"version": version})
+        params: dict = {
+            "version": version,
+            "protocol_min": PROTOCOL_MIN,
+            "protocol_max": PROTOCOL_MAX,
+        }
+        if binary:
+            params["framing"] = ["binary"]
+        if compress:
+            params["compression"] = ["gzip"]
+            params["compress_min_size"] = compress_min_size
+        result = self.call("Hello", params)
+        self._binary = result.get("framing") == "binary"
+        if result.get("compression") == "gzip":
+            self._compress_min = compress_min_size
+            self._reader = _BlockReader(self._stdout)
         daemon_version = result.get("version", "")
         if daemon_version != version:
             raise FastAgentVersionMismatch(version, daemon_version)
         return result
 
+    def batch(
+        self, requests: list[tuple[str, dict]], stop_on_error: bool = False
+    ) -> list[dict]:
+        """Run several (method, params) requests in one round trip.
+
+        Returns one response dict per request that ran, in order, each with
+        either "result" or "error". With stop_on_error the list ends at the
+        first failure.
+        """
+        result = self.call("Batch", {
+            "requests": [
+                {"id": i, "method": method, "params": params or {}}
+                for i, (method, params) in enumerate(requests)
+            ],
+            "stop_on_error": stop_on_error,
+        })
+        return result.get("results", [])
+
     def exec(
         self,
         argv: list[str] | None = None,
@@ -174,6 +360,7 @@ class FastAgentClient:
         stdin_add_newline: bool = True,
         strip_empty_ends: bool = True,
         become_user: str | None = None,
+        stream: bool = False,
     ) -> dict:
         """Execute a command on the remote host.
 
@@ -181,6 +368,10 @@ class FastAgentClient:
         `sudo -H -n -u <become_user> --` so it runs as that user. This
         requires the agent to be running as root, which is the case
         whenever Ansible's `become: true` is in effect.
+
+        If stream is set, the agent sends the command's output as
+        ExecOutput notifications while it runs; they are delivered to the
+        client's on_notification callback.
         """
         params = {"use_shell": use_shell}
         if argv is not None:
@@ -203,6 +394,8 @@ class FastAgentClient:
         params["strip_empty_ends"] = strip_empty_ends
         if become_user is not None:
             params["become_user"] = become_user
+        if stream:
+            params["stream"] = True
         return self.call("Exec", params)
 
     def stat(
@@ -233,7 +426,10 @@ class FastAgentClient:
 
         Does NOT support become_user; same rationale as `stat`.
         """
-        return self.call("ReadFile", {"path": path})
+        result, payload = self.call_with_payload("ReadFile", {"path": path})
+        if self._binary:
+            result["content"] = base64.b64encode(payload).decode("ascii")
+        return result
 
     def write_file(
         self,
@@ -258,7 +454,12 @@ class FastAgentClient:
             unsafe_writes: write directly instead of atomic rename
             checksum: expected checksum of existing file (skip if matches)
         """
-        params: dict = {"dest": dest, "content": content}
+        payload = b""
+        if self._binary:
+            payload = base64.b64decode(content)
+            params: dict = {"dest": dest}
+        else:
+            params = {"dest": dest, "content": content}
         if owner is not None:
             params["owner"] = owner
         if group is not None:
@@ -271,7 +472,7 @@ class FastAgentClient:
             params["unsafe_writes"] = True
         if checksum is not None:
             params["checksum"] = checksum
-        return self.call("WriteFile", params)
+        return self.call_with_payload("WriteFile", params, payload)[0]
 
     def file(
         self,
@@ -11,6 +11,8 @@ import tempfile
 import unittest
 
 from fastagent_client import (
+    CODE_NOT_FOUND,
+    CODE_UNSUPPORTED,
     FastAgentClient,
     FastAgentError,
     FastAgentVersionMismatch,
@@ -97,6 +99,8 @@ class TestHello(unittest.TestCase):
             self.assertIn("capabilities", result)
             self.assertIsInstance(result["capabilities"], list)
             self.assertGreater(len(result["capabilities"]), 0)
+            self.assertEqual(result["protocol"], 1)
+            self.assertIn("checksum_algorithm", result["methods"]["Stat"]["params"])
 
     def test_hello_version_mismatch(self):
         with AgentSession() as client:
@@ -158,6 +162,21 @@ class TestExec(unittest.TestCase):
             self.assertEqual(result["rc"], 0)
             self.assertIn("hello from stdin", result["stdout"])
 
+    def test_stream(self):
+        with AgentSession() as client:
+            chunks = []
+            client._on_notification = lambda method, params: chunks.append(
+                (method, params)
+            )
+            result = client.exec(cmd_string="echo streamed", use_shell=True, stream=True)
+            self.assertEqual(result["stdout"], "streamed")
+            self.assertTrue(chunks)
+            self.assertTrue(all(method == "ExecOutput" for method, _ in chunks))
+            self.assertEqual(
+                "".join(params.get("stdout", "") for _, params in chunks),
+                "streamed\n",
+            )
+
 
 class TestStat(unittest.TestCase):
     def test_existing_file(self):
@@ -248,6 +267,50 @@ class TestWriteAndReadFile(unittest.TestCase):
                     self.assertEqual(f.read(), b"original")
 
 
+    def test_binary_framing(self):
+        with AgentSession() as client:
+            result = client.hello(_get_agent_version(), binary=True)
+            self.assertEqual(result["framing"], "binary")
+            with tempfile.TemporaryDirectory() as d:
+                dest = os.path.join(d, "binary.bin")
+                content = bytes(range(256)) * 4
+                b64 = base64.b64encode(content).decode("ascii")
+
+                result = client.write_file(dest=dest, content=b64)
+                self.assertTrue(result["changed"])
+                with open(dest, "rb") as f:
+                    self.assertEqual(f.read(), content)
+
+                result = client.read_file(dest)
+                self.assertEqual(base64.b64decode(result["content"]), content)
+                self.assertEqual(result["size"], len(content))
+
+                result = client.stat(dest)
+                self.assertEqual(result["size"], len(content))
+
+
+    def test_compression(self):
+        for binary in (False, True):
+            with AgentSession() as client:
+                result = client.hello(
+                    _get_agent_version(), binary=binary, compress=True, compress_min_size=64
+                )
+                self.assertEqual(result["compression"], "gzip")
+                with tempfile.TemporaryDirectory() as d:
+                    dest = os.path.join(d, "compressible.txt")
+                    content = b"the same line over and over\n" * 100000
+                    b64 = base64.b64encode(content).decode("ascii")
+
+                    client.write_file(dest=dest, content=b64)
+                    with open(dest, "rb") as f:
+                        self.assertEqual(f.read(), content)
+                    result = client.read_file(dest)
+                    self.assertEqual(base64.b64decode(result["content"]), content)
+
+                    # Small messages go out uncompressed.
+                    result = client.exec(argv=["echo", "hi"])
+                    self.assertEqual(result["stdout"], "hi")
+
 class TestFile(unittest.TestCase):
     def test_create_directory(self):
         with AgentSession() as client:
@@ -309,6 +372,34 @@ class TestFile(unittest.TestCase):
                 self.assertFalse(result["changed"])
 
 
+class TestBatch(unittest.TestCase):
+    def test_batch(self):
+        with AgentSession() as client:
+            with tempfile.TemporaryDirectory() as d:
+                paths = [os.path.join(d, f"dir{i}") for i in range(5)]
+                results = client.batch(
+                    [("File", {"path": p, "state": "directory"}) for p in paths]
+                    + [("Bogus", {})]
+                )
+                self.assertEqual(len(results), 6)
+                for r in results[:5]:
+                    self.assertTrue(r["result"]["changed"])
+                self.assertIn("error", results[5])
+                for p in paths:
+                    self.assertTrue(os.path.isdir(p))
+
+    def test_batch_stop_on_error(self):
+        with AgentSession() as client:
+            results = client.batch(
+                [
+                    ("ReadFile", {"path": "/nonexistent-path-fastagent-test"}),
+                    ("Exec", {"argv": ["true"]}),
+                ],
+                stop_on_error=True,
+            )
+            self.assertEqual(len(results), 1)
+            self.assertIn("error", results[0])
+
 class TestErrorHandling(unittest.TestCase):
     def test_unknown_method(self):
         with AgentSession() as client:
@@ -318,8 +409,17 @@ class TestErrorHandling(unittest.TestCase):
 
     def test_read_nonexistent_file(self):
         with AgentSession() as client:
-            with self.assertRaises(FastAgentError):
+            with self.assertRaises(FastAgentError) as ctx:
                 client.read_file("/nonexistent-path-fastagent-test")
+            self.assertEqual(ctx.exception.code, CODE_NOT_FOUND)
+            self.assertEqual(ctx.exception.data["errno"], "ENOENT")
+
+    def test_unsupported_param(self):
+        with AgentSession() as client:
+            with self.assertRaises(FastAgentError) as ctx:
+                client.call("File", {"path": "/tmp", "state": "bogus"})
+            self.assertEqual(ctx.exception.code, CODE_UNSUPPORTED)
+            self.assertEqual(ctx.exception.data["param"], "state")
 
     def test_exec_no_command(self):
         with AgentSession() as client:
@@ -2,91 +2,355 @@ package fastagent
 
 import (
 	"bufio"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
+// DefaultMaxConcurrency is how many requests a single connection may have
+// in flight at once when Server.MaxConcurrency is unset.
+const DefaultMaxConcurrency = 16
+
 // Server handles JSON-RPC requests from an Ansible controller.
 type Server struct {
 	Logger *slog.Logger
+
+	// MaxConcurrency bounds the number of requests Serve dispatches
+	// concurrently on a single connection. Zero means
+	// DefaultMaxConcurrency.
+	MaxConcurrency int
+
+	// JobDir is where background job results are persisted. Empty
+	// means ~/.ansible_async, Ansible's default async_dir.
+	JobDir string
+
+	jobsOnce sync.Once
+	jobs     *jobTable
+}
+
+// session is the per-connection state for one call to Serve.
+type session struct {
+	// wmu serializes writes to mw; handlers finish in any order and
+	// each response must land on the wire as a single message. Hello
+	// swaps mw when it negotiates a different framing.
+	wmu    sync.Mutex
+	mw     messageWriter
+	werr   error
+	failed atomic.Bool
+
+	// cancel aborts every request on the connection. It fires when the
+	// peer goes away, either noticed as a failed write or (on sockets)
+	// as a hangup.
+	cancel context.CancelFunc
+
+	// format is the connection's current wire format and negotiated
+	// whether a Hello has set it. Only Serve's goroutine touches them.
+	format     wireFormat
+	negotiated bool
+
+	mu       sync.Mutex
+	inflight map[int64]*call
+	uploads  map[string]*upload
+}
+
+// call is the state for one in-flight request. It travels in the
+// handler's context so handlers can reach their connection.
+type call struct {
+	id     int64
+	sess   *session
+	cancel context.CancelFunc
+
+	// binary is set when the request arrived in binary framing. payload
+	// is the request's raw payload, and respPayload the one to send with
+	// the response; see FramingBinary.
+	binary      bool
+	payload     []byte
+	respPayload []byte
+
+	// format is the wire format Hello agreed to switch to, if any.
+	format *wireFormat
+}
+
+type callKey struct{}
+
+// callFromContext returns the call for the request being handled, or nil
+// when the handler was invoked outside Serve (as some tests do).
+func callFromContext(ctx context.Context) *call {
+	c, _ := ctx.Value(callKey{}).(*call)
+	return c
+}
+
+// notify sends a notification on the call's connection.
+func (c *call) notify(method string, params any) {
+	c.sess.write(Notification{Method: method, Params: params}, nil)
+}
+
+// requestContent returns the file content a request carries: the frame
+// payload in binary framing, or else content decoded from base64. A binary
+// request with no payload may still send base64 content.
+func requestContent(ctx context.Context, content string) ([]byte, error) {
+	if c := callFromContext(ctx); c != nil && c.binary && (len(c.payload) > 0 || content == "") {
+		return c.payload, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return nil, invalidParams("decode content: %w", err)
+	}
+	return data, nil
+}
+
+// responseContent arranges for data to go back to the controller. In binary
+// framing it becomes the response payload and the returned content is
+// empty; otherwise it's returned base64-encoded for the result's content
+// field.
+func responseContent(ctx context.Context, data []byte) string {
+	if c := callFromContext(ctx); c != nil && c.binary {
+		c.respPayload = data
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// write sends v (with payload, in framings that carry one) as one message.
+// After the first write error every subsequent write is dropped, in-flight
+// requests are cancelled since nobody is left to read their results, and
+// the error is reported by Serve.
+func (sess *session) write(v any, payload []byte) {
+	sess.wmu.Lock()
+	defer sess.wmu.Unlock()
+	sess.writeLocked(v, payload)
+}
+
+func (sess *session) writeLocked(v any, payload []byte) {
+	if sess.werr != nil {
+		return
+	}
+	if err := sess.mw.writeMessage(v, payload); err != nil {
+		sess.werr = err
+		sess.failed.Store(true)
+		sess.cancel()
+	}
+}
+
+// upgrade writes the Hello response in the current format and switches to
+// format for everything after it, with no other message in between.
+func (sess *session) upgrade(resp Response, format wireFormat, w io.Writer) {
+	sess.wmu.Lock()
+	defer sess.wmu.Unlock()
+	sess.writeLocked(resp, nil)
+	sess.mw = format.writer(w)
+}
+
+// begin registers a request as in flight and returns the context its
+// handler should run under.
+func (sess *session) begin(ctx context.Context, id int64) (context.Context, *call) {
+	ctx, cancel := context.WithCancel(ctx)
+	c := &call{id: id, sess: sess, cancel: cancel}
+	sess.mu.Lock()
+	sess.inflight[id] = c
+	sess.mu.Unlock()
+	return context.WithValue(ctx, callKey{}, c), c
+}
+
+// end unregisters c. A later request reusing the same ID may have replaced
+// it already, in which case the newer entry is left alone.
+func (sess *session) end(c *call) {
+	sess.mu.Lock()
+	if sess.inflight[c.id] == c {
+		delete(sess.inflight, c.id)
+	}
+	sess.mu.Unlock()
+	c.cancel()
+}
+
+// cancelRequest cancels the in-flight request with the given ID, reporting
+// whether there was one.
+func (sess *session) cancelRequest(id int64) bool {
+	sess.mu.Lock()
+	c, ok := sess.inflight[id]
+	sess.mu.Unlock()
+	if ok {
+		c.cancel()
+	}
+	return ok
 }
 
 // Serve reads newline-delimited JSON requests from r and writes responses to w.
-// It blocks until r is closed or an unrecoverable error occurs.
+// It blocks until r is closed or an unrecoverable error occurs. A controller
+// may negotiate binary framing or compression in Hello, after which both
+// directions switch to it; see FramingBinary and CompressionGzip.
+//
+// Requests are dispatched concurrently, up to MaxConcurrency at a time, so a
+// slow Exec doesn't hold up a Stat sent behind it. Responses are written as
+// they complete and may arrive out of order; controllers match them to
+// requests by ID. Serve waits for in-flight requests to finish before
+// returning, unless the peer hangs up, in which case they are cancelled.
 func (s *Server) Serve(r io.Reader, w io.Writer) error {
-	scanner := bufio.NewScanner(r)
-	// Allow up to 64MB messages (for large file transfers).
-	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
-	enc := json.NewEncoder(w)
-
-	for scanner.Scan() {
-		line := scanner.Bytes()
-		if len(line) == 0 {
-			continue
+	br := bufio.NewReaderSize(r, 64*1024)
+	mr := defaultWireFormat.reader(br)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sess := &session{
+		mw:       defaultWireFormat.writer(w),
+		format:   defaultWireFormat,
+		cancel:   cancel,
+		inflight: make(map[int64]*call),
+	}
+
+	defer sess.abortUploads()
+
+	limit := s.MaxConcurrency
+	if limit <= 0 {
+		limit = DefaultMaxConcurrency
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	var rerr error
+
+	for !sess.failed.Load() {
+		header, payload, err := mr.readMessage()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				rerr = err
+			}
+			break
 		}
 
 		var req Request
-		if err := json.Unmarshal(line, &req); err != nil {
+		if err := json.Unmarshal(header, &req); err != nil {
 			s.Logger.Error("failed to unmarshal request", "error", err)
-			resp := Response{
+			sess.write(Response{
 				ID:    0,
-				Error: &ErrorInfo{Code: -32700, Message: "parse error: " + err.Error()},
-			}
-			if err := enc.Encode(resp); err != nil {
-				return fmt.Errorf("writing error response: %w", err)
-			}
+				Error: &ErrorInfo{Code: CodeParseError, Message: "parse error: " + err.Error()},
+			}, nil)
 			continue
 		}
 
 		s.Logger.Debug("received request", "id", req.ID, "method", req.Method)
-		resp := s.dispatch(req)
-		if err := enc.Encode(resp); err != nil {
-			return fmt.Errorf("writing response: %w", err)
+		binary := sess.format.framing == FramingBinary
+		switch req.Method {
+		case "Hello":
+			// Hello is answered inline so that nothing is read in the
+			// old format after it agrees to a new one.
+			c := &call{id: req.ID, sess: sess, binary: binary}
+			resp := s.dispatch(context.WithValue(ctx, callKey{}, c), req)
+			if c.format == nil || *c.format == sess.format {
+				sess.write(resp, nil)
+				continue
+			}
+			sess.format = *c.format
+			sess.negotiated = true
+			sess.upgrade(resp, sess.format, w)
+			// Bytes already buffered in br belong to the new format, so
+			// it stays underneath whatever the new reader adds.
+			mr = sess.format.reader(br)
+			s.Logger.Debug("switched wire format", "framing", sess.format.framing, "compression", sess.format.compression)
+			continue
+		case "Cancel":
+			// Cancel is answered inline: it has to get through even when
+			// the pool is full of the very requests it means to stop.
+			sess.write(s.dispatch(context.WithValue(ctx, callKey{}, &call{id: req.ID, sess: sess}), req), nil)
+			continue
 		}
+		// Acquire before spawning so a full pool stops us reading more
+		// input rather than piling up goroutines.
+		sem <- struct{}{}
+		wg.Add(1)
+		reqCtx, c := sess.begin(ctx, req.ID)
+		c.binary = binary
+		c.payload = payload
+		go func() {
+			defer func() {
+				sess.end(c)
+				<-sem
+				wg.Done()
+			}()
+			resp := s.dispatch(reqCtx, req)
+			sess.write(resp, c.respPayload)
+		}()
 	}
 
-	if err := scanner.Err(); err != nil && !errors.Is(err, io.EOF) {
-		return fmt.Errorf("reading requests: %w", err)
+	// EOF alone doesn't mean the controller is gone: RunConnect shuts
+	// down its write side once stdin is exhausted and keeps reading
+	// responses. A full close of a socket shows up as a hangup, though,
+	// and then nobody is left to read what the handlers produce.
+	if conn, ok := r.(net.Conn); ok {
+		if sc, ok := conn.(syscall.Conn); ok {
+			go watchHangup(ctx, sc, cancel)
+		}
+	}
+	wg.Wait()
+
+	if sess.werr != nil {
+		return fmt.Errorf("writing response: %w", sess.werr)
+	}
+	if rerr != nil {
+		return fmt.Errorf("reading requests: %w", rerr)
 	}
 	return nil
 }
 
-func (s *Server) dispatch(req Request) Response {
-	var result any
-	var err error
-
-	switch req.Method {
-	case "Hello":
-		result, err = s.handleHello(req.Params)
-	case "Exec":
-		result, err = s.handleExec(req.Params)
-	case "Stat":
-		result, err = s.handleStat(req.Params)
-	case "ReadFile":
-		result, err = s.handleReadFile(req.Params)
-	case "WriteFile":
-		result, err = s.handleWriteFile(req.Params)
-	case "File":
-		result, err = s.handleFile(req.Params)
-	case "Package":
-		result, err = s.handlePackage(req.Params)
-	case "Service":
-		result, err = s.handleService(req.Params)
-	default:
+// watchHangup polls conn until ctx is done, calling cancel if the peer has
+// fully closed it. A peer that only shut down its write side doesn't
+// raise POLLHUP.
+func watchHangup(ctx context.Context, conn syscall.Conn, cancel context.CancelFunc) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	for ctx.Err() == nil {
+		hup := false
+		err := raw.Control(func(fd uintptr) {
+			fds := []unix.PollFd{{Fd: int32(fd)}}
+			n, err := unix.Poll(fds, 250)
+			hup = err == nil && n > 0 && fds[0].Revents&(unix.POLLHUP|unix.POLLERR) != 0
+		})
+		if err != nil {
+			return
+		}
+		if hup {
+			cancel()
+			return
+		}
+	}
+}
+
+func (s *Server) dispatch(ctx context.Context, req Request) Response {
+	m, ok := methods[req.Method]
+	if !ok {
 		return Response{
 			ID:    req.ID,
-			Error: &ErrorInfo{Code: -32601, Message: "unknown method: " + req.Method},
+			Error: &ErrorInfo{Code: CodeMethodNotFound, Message: "unknown method: " + req.Method},
 		}
 	}
+	result, err := m.handle(s, ctx, req.Params)
 
 	if err != nil {
+		// A handler that fails after its context was cancelled failed
+		// because of the cancellation (a killed child, typically), so
+		// report that rather than whatever the child's death looked like.
+		if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+			s.Logger.Info("request cancelled", "method", req.Method, "id", req.ID)
+			return Response{
+				ID:    req.ID,
+				Error: &ErrorInfo{Code: CodeCancelled, Message: "cancelled: " + err.Error()},
+			}
+		}
 		s.Logger.Error("handler error", "method", req.Method, "error", err)
 		return Response{
 			ID:    req.ID,
-			Error: &ErrorInfo{Code: 1, Message: err.Error()},
+			Error: errorInfo(err),
 		}
 	}
 
@@ -96,17 +360,93 @@ func (s *Server) dispatch(req Request) Response {
 	}
 }
 
-func (s *Server) handleHello(params json.RawMessage) (any, error) {
+func (s *Server) handleHello(ctx context.Context, params json.RawMessage) (any, error) {
 	var p HelloParams
 	if err := json.Unmarshal(params, &p); err != nil {
-		return nil, fmt.Errorf("unmarshal HelloParams: %w", err)
+		return nil, invalidParams("unmarshal HelloParams: %w", err)
+	}
+	protocol, err := negotiateProtocol(p)
+	if err != nil {
+		return nil, err
 	}
-	s.Logger.Info("hello from controller", "controller_version", p.Version)
+	// Only the first Hello on a connection picks the format. Switching
+	// again would strand whatever the current reader has buffered.
+	format := defaultWireFormat
+	if c := callFromContext(ctx); c != nil {
+		if c.sess.negotiated {
+			format = c.sess.format
+		} else {
+			format = negotiateWireFormat(p)
+		}
+		c.format = &format
+	}
+	s.Logger.Info("hello from controller", "controller_version", p.Version,
+		"framing", format.framing, "compression", format.compression)
 	return HelloResult{
 		Version: Version,
 		Capabilities: []string{
 			"exec", "stat", "read_file", "write_file", "file",
-			"package", "service",
+			"package", "service", "cancel", "jobs", "chunked_transfer",
+			"binary_framing", "compression", "batch",
 		},
+		Framing:     format.framing,
+		Compression: format.compression,
+		Protocol:    protocol,
+		Methods:     methodInfos(),
 	}, nil
 }
+
+// negotiateProtocol picks the highest protocol version both sides speak.
+func negotiateProtocol(p HelloParams) (int, error) {
+	lo, hi := max(p.ProtocolMin, 1), max(p.ProtocolMax, 1)
+	if lo > hi {
+		return 0, invalidParams("hello: invalid protocol range %d-%d", lo, hi)
+	}
+	version := min(hi, MaxProtocolVersion)
+	if version < max(lo, MinProtocolVersion) {
+		return 0, unsupported("protocol_max", "hello: incompatible protocol: controller speaks versions %d-%d, agent speaks %d-%d",
+			lo, hi, MinProtocolVersion, MaxProtocolVersion)
+	}
+	return version, nil
+}
+
+// negotiateWireFormat picks the first framing and compression in the
+// controller's preference lists that the agent supports.
+func negotiateWireFormat(p HelloParams) wireFormat {
+	format := defaultWireFormat
+	for _, f := range p.Framing {
+		if f == FramingNDJSON || f == FramingBinary {
+			format.framing = f
+			break
+		}
+	}
+	for _, c := range p.Compression {
+		if c == CompressionNone || c == CompressionGzip {
+			format.compression = c
+			break
+		}
+	}
+	if format.compression == CompressionGzip {
+		format.compressMinSize = DefaultCompressMinSize
+		if p.CompressMinSize > 0 {
+			format.compressMinSize = p.CompressMinSize
+		}
+	}
+	return format
+}
+
+// handleCancel aborts another request on the same connection. The
+// cancelled request still gets its own response, with CodeCancelled.
+func (s *Server) handleCancel(ctx context.Context, params json.RawMessage) (any, error) {
+	var p CancelParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, invalidParams("unmarshal CancelParams: %w", err)
+	}
+	c := callFromContext(ctx)
+	if c == nil {
+		return nil, fmt.Errorf("cancel: no connection")
+	}
+	cancelled := c.sess.cancelRequest(p.ID)
+	s.Logger.Debug("cancel", "target", p.ID, "cancelled", cancelled)
+	return CancelResult{Cancelled: cancelled}, nil
+}
@@ -3,11 +3,19 @@ package fastagent
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"os"
 	"os/user"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func newTestServer() *Server {
@@ -336,16 +344,365 @@ func TestMultipleRequests(t *testing.T) {
 		t.Fatalf("got %d responses, want 3", len(lines))
 	}
 
+	// Responses may arrive in any order; every ID must show up once.
+	seen := make(map[int64]bool)
 	for i, line := range lines {
 		var resp Response
 		if err := json.Unmarshal([]byte(line), &resp); err != nil {
 			t.Fatalf("line %d: %v", i, err)
 		}
-		if resp.ID != int64(i+1) {
-			t.Errorf("line %d: got id %d, want %d", i, resp.ID, i+1)
+		if seen[resp.ID] {
+			t.Errorf("line %d: duplicate response for id %d", i, resp.ID)
 		}
+		seen[resp.ID] = true
 		if resp.Error != nil {
 			t.Errorf("line %d: unexpected error: %v", i, resp.Error)
 		}
 	}
+	for id := int64(1); id <= 3; id++ {
+		if !seen[id] {
+			t.Errorf("missing response for id %d", id)
+		}
+	}
+}
+
+// TestServeDispatchesConcurrently checks that a slow request doesn't block
+// the ones behind it: the Hello sent after a sleeping Exec must be answered
+// first.
+func TestServeDispatchesConcurrently(t *testing.T) {
+	s := newTestServer()
+
+	var input bytes.Buffer
+	for _, req := range []Request{
+		{ID: 1, Method: "Exec", Params: json.RawMessage(`{"argv":["sleep","0.5"]}`)},
+		{ID: 2, Method: "Hello", Params: json.RawMessage(`{"version":"test"}`)},
+	} {
+		data, _ := json.Marshal(req)
+		input.Write(data)
+		input.WriteByte('\n')
+	}
+
+	var output bytes.Buffer
+	if err := s.Serve(&input, &output); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d responses, want 2", len(lines))
+	}
+	var first Response
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != 2 {
+		t.Errorf("first response has id %d, want the Hello (2) ahead of the slow Exec", first.ID)
+	}
+}
+
+func TestServeBoundsConcurrency(t *testing.T) {
+	s := newTestServer()
+	s.MaxConcurrency = 1
+
+	var input bytes.Buffer
+	for _, req := range []Request{
+		{ID: 1, Method: "Exec", Params: json.RawMessage(`{"argv":["sleep","0.2"]}`)},
+		// Not Hello: that's answered inline, outside the pool.
+		{ID: 2, Method: "Stat", Params: json.RawMessage(`{"path":"/"}`)},
+	} {
+		data, _ := json.Marshal(req)
+		input.Write(data)
+		input.WriteByte('\n')
+	}
+
+	var output bytes.Buffer
+	if err := s.Serve(&input, &output); err != nil {
+		t.Fatal(err)
+	}
+
+	var first Response
+	line, _, _ := strings.Cut(output.String(), "\n")
+	if err := json.Unmarshal([]byte(line), &first); err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != 1 {
+		t.Errorf("first response has id %d, want 1 with MaxConcurrency=1", first.ID)
+	}
+}
+
+// serveConn runs s.Serve over a pair of pipes so tests can interleave
+// requests and responses. The returned stop function closes the request
+// stream and waits for Serve to return.
+func serveConn(t *testing.T, s *Server) (send func(Request), recv func() Response, stop func()) {
+	t.Helper()
+
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := s.Serve(inR, outW)
+		outW.Close()
+		done <- err
+	}()
+
+	dec := json.NewDecoder(outR)
+	send = func(req Request) {
+		t.Helper()
+		data, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := inW.Write(append(data, '\n')); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recv = func() Response {
+		t.Helper()
+		var resp Response
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+		return resp
+	}
+	stop = func() {
+		t.Helper()
+		inW.Close()
+		go io.Copy(io.Discard, outR)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return send, recv, stop
+}
+
+// waitForPID waits for a command under test to write its background
+// child's PID to path.
+func waitForPID(t *testing.T, path string) int {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		data, err := os.ReadFile(path)
+		if err == nil && strings.HasSuffix(string(data), "\n") {
+			pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return pid
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", path)
+	return 0
+}
+
+// processGone reports whether pid has exited. An exited child that got
+// reparented may linger as a zombie if nothing reaps it, which counts.
+func processGone(pid int) bool {
+	if unix.Kill(pid, 0) != nil {
+		return true
+	}
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	_, rest, _ := strings.Cut(string(data), ") ")
+	return strings.HasPrefix(rest, "Z")
+}
+
+func waitProcessGone(t *testing.T, pid int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !processGone(pid) {
+		if time.Now().After(deadline) {
+			unix.Kill(pid, unix.SIGKILL)
+			t.Fatalf("process %d still running", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCancelExecKillsProcessGroup(t *testing.T) {
+	s := newTestServer()
+	send, recv, stop := serveConn(t, s)
+	defer stop()
+
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	params, _ := json.Marshal(ExecParams{
+		CmdString: "sleep 30 & echo $! > " + pidFile + "; wait",
+		UseShell:  true,
+	})
+	send(Request{ID: 1, Method: "Exec", Params: params})
+	pid := waitForPID(t, pidFile)
+
+	send(Request{ID: 2, Method: "Cancel", Params: json.RawMessage(`{"id":1}`)})
+	for range 2 {
+		resp := recv()
+		switch resp.ID {
+		case 1:
+			if resp.Error == nil || resp.Error.Code != CodeCancelled {
+				t.Errorf("exec response: got error %+v, want code %d", resp.Error, CodeCancelled)
+			}
+		case 2:
+			if resp.Error != nil {
+				t.Fatalf("cancel: unexpected error: %v", resp.Error)
+			}
+			resultJSON, _ := json.Marshal(resp.Result)
+			var result CancelResult
+			if err := json.Unmarshal(resultJSON, &result); err != nil {
+				t.Fatal(err)
+			}
+			if !result.Cancelled {
+				t.Error("expected cancelled=true for an in-flight request")
+			}
+		default:
+			t.Fatalf("unexpected response id %d", resp.ID)
+		}
+	}
+	waitProcessGone(t, pid)
+}
+
+func TestCancelUnknownRequest(t *testing.T) {
+	s := newTestServer()
+	resp := rpcCall(t, s, "Cancel", CancelParams{ID: 42})
+	if resp.Error != nil {
+		t.Fatalf("unexpected error: %v", resp.Error)
+	}
+	resultJSON, _ := json.Marshal(resp.Result)
+	var result CancelResult
+	if err := json.Unmarshal(resultJSON, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Cancelled {
+		t.Error("expected cancelled=false when nothing is in flight")
+	}
+}
+
+// TestConnectionCloseCancelsRequests checks that a controller hanging up
+// on the daemon socket kills what it started instead of leaving it running
+// as root on the target.
+func TestConnectionCloseCancelsRequests(t *testing.T) {
+	s := newTestServer()
+
+	dir := t.TempDir()
+	ln, err := net.Listen("unix", filepath.Join(dir, "sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			served <- err
+			return
+		}
+		defer conn.Close()
+		served <- s.Serve(conn, conn)
+	}()
+
+	client, err := net.Dial("unix", filepath.Join(dir, "sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidFile := filepath.Join(dir, "pid")
+	params, _ := json.Marshal(ExecParams{
+		CmdString: "sleep 30 & echo $! > " + pidFile + "; wait",
+		UseShell:  true,
+	})
+	data, _ := json.Marshal(Request{ID: 1, Method: "Exec", Params: params})
+	if _, err := client.Write(append(data, '\n')); err != nil {
+		t.Fatal(err)
+	}
+	pid := waitForPID(t, pidFile)
+	client.Close()
+
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the client hung up")
+	}
+	waitProcessGone(t, pid)
+}
+
+func TestExecStreamsOutput(t *testing.T) {
+	s := newTestServer()
+
+	params, _ := json.Marshal(ExecParams{
+		CmdString: "echo one; echo two >&2; sleep 0.1; echo three",
+		UseShell:  true,
+		Stream:    true,
+	})
+	data, _ := json.Marshal(Request{ID: 7, Method: "Exec", Params: params})
+	var output bytes.Buffer
+	if err := s.Serve(bytes.NewReader(append(data, '\n')), &output); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr strings.Builder
+	var final *ExecResult
+	for line := range strings.SplitSeq(strings.TrimSpace(output.String()), "\n") {
+		if final != nil {
+			t.Fatalf("got %q after the final response", line)
+		}
+		var msg struct {
+			ID     *int64          `json:"id"`
+			Method string          `json:"method"`
+			Params ExecOutput      `json:"params"`
+			Result json.RawMessage `json:"result"`
+		}
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case msg.Method == "ExecOutput":
+			if msg.ID != nil {
+				t.Errorf("notification %q has a top-level id", line)
+			}
+			if msg.Params.ID != 7 {
+				t.Errorf("notification tagged with request %d, want 7", msg.Params.ID)
+			}
+			stdout.WriteString(msg.Params.Stdout)
+			stderr.WriteString(msg.Params.Stderr)
+		case msg.ID != nil && *msg.ID == 7:
+			final = new(ExecResult)
+			if err := json.Unmarshal(msg.Result, final); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			t.Fatalf("unexpected line %q", line)
+		}
+	}
+	if final == nil {
+		t.Fatal("no final ExecResult")
+	}
+	if stdout.String() != "one\nthree\n" {
+		t.Errorf("streamed stdout = %q, want %q", stdout.String(), "one\nthree\n")
+	}
+	if stderr.String() != "two\n" {
+		t.Errorf("streamed stderr = %q, want %q", stderr.String(), "two\n")
+	}
+	if final.Stdout != "one\nthree" {
+		t.Errorf("final stdout = %q, want the complete output", final.Stdout)
+	}
+}
+
+func TestCompleteUTF8(t *testing.T) {
+	euro := []byte("€") // three bytes
+	cases := []struct {
+		in   []byte
+		want int
+	}{
+		{in: []byte("abc"), want: 3},
+		{in: append([]byte("a"), euro...), want: 4},
+		{in: append([]byte("a"), euro[:1]...), want: 1},
+		{in: append([]byte("a"), euro[:2]...), want: 1},
+		{in: []byte{0xff, 0xfe}, want: 2}, // invalid bytes aren't held back
+		{in: nil, want: 0},
+	}
+	for _, tc := range cases {
+		if got := completeUTF8(tc.in); got != tc.want {
+			t.Errorf("completeUTF8(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
 }
@@ -1,19 +1,25 @@
 package fastagent
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"os/exec"
 	"strings"
 )
 
-func (s *Server) handleService(params json.RawMessage) (any, error) {
+// serviceManagers and serviceStates are what handleService accepts.
+var (
+	serviceManagers = []string{"systemd"}
+	serviceStates   = []string{"started", "stopped", "restarted", "reloaded"}
+)
+
+func (s *Server) handleService(ctx context.Context, params json.RawMessage) (any, error) {
 	var p ServiceParams
 	if err := json.Unmarshal(params, &p); err != nil {
-		return nil, fmt.Errorf("unmarshal ServiceParams: %w", err)
+		return nil, invalidParams("unmarshal ServiceParams: %w", err)
 	}
 	if p.Name == "" {
-		return nil, fmt.Errorf("service name is required")
+		return nil, invalidParams("service name is required")
 	}
 	if p.Manager == "" {
 		p.Manager = "systemd"
@@ -21,20 +27,20 @@ func (s *Server) handleService(params json.RawMessage) (any, error) {
 
 	switch p.Manager {
 	case "systemd":
-		return s.handleServiceSystemd(p)
+		return s.handleServiceSystemd(ctx, p)
 	default:
-		return nil, fmt.Errorf("unsupported service manager: %q", p.Manager)
+		return nil, unsupported("manager", "unsupported service manager: %q", p.Manager)
 	}
 }
 
-func (s *Server) handleServiceSystemd(p ServiceParams) (any, error) {
+func (s *Server) handleServiceSystemd(ctx context.Context, p ServiceParams) (any, error) {
 	changed := false
 
 	// Get current state.
-	activeOut, _ := exec.Command("systemctl", "is-active", p.Name).Output()
+	activeOut, _ := commandContext(ctx, "systemctl", "is-active", p.Name).Output()
 	currentActive := strings.TrimSpace(string(activeOut))
 
-	enabledOut, _ := exec.Command("systemctl", "is-enabled", p.Name).Output()
+	enabledOut, _ := commandContext(ctx, "systemctl", "is-enabled", p.Name).Output()
 	currentEnabled := strings.TrimSpace(string(enabledOut)) == "enabled"
 
 	// Handle state changes.
@@ -60,13 +66,13 @@ func (s *Server) handleServiceSystemd(p ServiceParams) (any, error) {
 			action = "reload"
 			needsAction = true
 		default:
-			return nil, fmt.Errorf("unsupported service state: %q", p.State)
+			return nil, unsupported("state", "unsupported service state: %q", p.State)
 		}
 
 		if needsAction {
-			cmd := systemctlCommand(p, action, p.Name)
+			cmd := systemctlCommand(ctx, p, action, p.Name)
 			if out, err := cmd.CombinedOutput(); err != nil {
-				return nil, fmt.Errorf("systemctl %s %s: %s\n%s", action, p.Name, err, string(out))
+				return nil, commandError("systemctl "+action+" "+p.Name, cmd, out, err)
 			}
 			changed = true
 		}
@@ -80,9 +86,9 @@ func (s *Server) handleServiceSystemd(p ServiceParams) (any, error) {
 			if want {
 				action = "enable"
 			}
-			cmd := systemctlCommand(p, action, p.Name)
+			cmd := systemctlCommand(ctx, p, action, p.Name)
 			if out, err := cmd.CombinedOutput(); err != nil {
-				return nil, fmt.Errorf("systemctl %s %s: %s\n%s", action, p.Name, err, string(out))
+				return nil, commandError("systemctl "+action+" "+p.Name, cmd, out, err)
 			}
 			changed = true
 			currentEnabled = want
@@ -91,7 +97,7 @@ func (s *Server) handleServiceSystemd(p ServiceParams) (any, error) {
 
 	// Re-check active state after changes.
 	if changed {
-		activeOut, _ = exec.Command("systemctl", "is-active", p.Name).Output()
+		activeOut, _ = commandContext(ctx, "systemctl", "is-active", p.Name).Output()
 		currentActive = strings.TrimSpace(string(activeOut))
 	}
 
@@ -103,11 +109,11 @@ func (s *Server) handleServiceSystemd(p ServiceParams) (any, error) {
 	}, nil
 }
 
-func systemctlCommand(p ServiceParams, args ...string) *exec.Cmd {
+func systemctlCommand(ctx context.Context, p ServiceParams, args ...string) *exec.Cmd {
 	cmdArgs := make([]string, 0, len(args)+1)
 	if p.NoBlock {
 		cmdArgs = append(cmdArgs, "--no-block")
 	}
 	cmdArgs = append(cmdArgs, args...)
-	return exec.Command("systemctl", cmdArgs...)
+	return commandContext(ctx, "systemctl", cmdArgs...)
 }
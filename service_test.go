@@ -1,6 +1,7 @@
 package fastagent
 
 import (
+	"context"
 	"encoding/json"
 	"os"
 	"path/filepath"
@@ -33,7 +34,7 @@ func TestHandleServiceSystemdPassesNoBlock(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = (&Server{}).handleService(params)
+	_, err = (&Server{}).handleService(context.Background(), params)
 	if err != nil {
 		t.Fatal(err)
 	}
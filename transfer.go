@@ -0,0 +1,333 @@
+package fastagent
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Chunked transfers move files too big to carry in one WriteFile or
+// ReadFile line. An upload streams into a temp file next to the
+// destination, so the eventual rename is atomic exactly like WriteFile's;
+// a download is a series of stateless ReadFileChunk calls.
+
+// uploadIdleTimeout is how long an upload may go without a chunk before
+// the agent gives up on it and removes its temp file. Uploads are also
+// removed when their connection closes.
+const uploadIdleTimeout = 10 * time.Minute
+
+// defaultChunkSize and maxChunkSize bound ReadFileChunk.Length. 4MB keeps
+// each response line small next to Serve's 64MB limit even after base64.
+const (
+	defaultChunkSize = 4 << 20
+	maxChunkSize     = 16 << 20
+)
+
+// upload is a WriteFile in progress.
+type upload struct {
+	id     string
+	params WriteFileParams
+	sha256 string
+
+	mu      sync.Mutex
+	tmp     *os.File
+	written int64
+	timer   *time.Timer
+}
+
+// discard closes and removes the temp file. It's safe to call more than
+// once.
+func (u *upload) discard() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.timer.Stop()
+	if u.tmp != nil {
+		u.tmp.Close()
+		os.Remove(u.tmp.Name())
+		u.tmp = nil
+	}
+}
+
+// takeUpload removes the upload from the session and returns it, so that
+// only one of commit, abort, or expiry gets to finish it.
+func (sess *session) takeUpload(id string) *upload {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	u := sess.uploads[id]
+	delete(sess.uploads, id)
+	return u
+}
+
+func (sess *session) getUpload(id string) (*upload, error) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	u, ok := sess.uploads[id]
+	if !ok {
+		return nil, newError(CodeNotFound, nil, "unknown upload %q (expired, committed, or started on another connection)", id)
+	}
+	return u, nil
+}
+
+// abortUploads discards every upload on the connection. Serve calls it on
+// the way out.
+func (sess *session) abortUploads() {
+	sess.mu.Lock()
+	uploads := sess.uploads
+	sess.uploads = nil
+	sess.mu.Unlock()
+	for _, u := range uploads {
+		u.discard()
+	}
+}
+
+func (s *Server) handleWriteFileBegin(ctx context.Context, params json.RawMessage) (any, error) {
+	var p WriteFileBeginParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, invalidParams("unmarshal WriteFileBeginParams: %w", err)
+	}
+	c := callFromContext(ctx)
+	if c == nil {
+		return nil, fmt.Errorf("write_file_begin: no connection")
+	}
+	if p.Dest == "" {
+		return nil, invalidParams("write_file_begin: dest is required")
+	}
+	// The upload's temp file is held open across requests, which a
+	// short-lived helper can't do.
+	if p.BecomeUser != "" {
+		return nil, unsupported("become_user", "write_file_begin: BecomeUser is not supported for chunked uploads; use WriteFile")
+	}
+
+	// The temp file lives in the destination directory so the final
+	// rename stays on one filesystem. Creating the parents now rather
+	// than at commit changes nothing: if they're missing, so is the
+	// file, and commit would have to create them anyway.
+	dir := filepath.Dir(p.Dest)
+	if err := mkdirAllOwned(dir, p.Owner, p.Group); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(dir, ".fastagent-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp: %w", err)
+	}
+
+	var b [12]byte
+	rand.Read(b[:])
+	u := &upload{
+		id:     hex.EncodeToString(b[:]),
+		params: p.WriteFileParams,
+		sha256: p.SHA256,
+		tmp:    tmp,
+	}
+	u.timer = time.AfterFunc(uploadIdleTimeout, func() {
+		if c.sess.takeUpload(u.id) != nil {
+			s.Logger.Warn("abandoned upload expired", "upload", u.id, "dest", p.Dest)
+			u.discard()
+		}
+	})
+
+	c.sess.mu.Lock()
+	if c.sess.uploads == nil {
+		c.sess.uploads = make(map[string]*upload)
+	}
+	c.sess.uploads[u.id] = u
+	c.sess.mu.Unlock()
+
+	s.Logger.Debug("upload started", "upload", u.id, "dest", p.Dest)
+	return WriteFileBeginResult{UploadID: u.id}, nil
+}
+
+// handleWriteFileChunk writes one chunk at its offset. Chunks may arrive in
+// any order (Serve handles requests concurrently), so they're placed with
+// WriteAt rather than appended.
+func (s *Server) handleWriteFileChunk(ctx context.Context, params json.RawMessage) (any, error) {
+	var p WriteFileChunkParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, invalidParams("unmarshal WriteFileChunkParams: %w", err)
+	}
+	c := callFromContext(ctx)
+	if c == nil {
+		return nil, fmt.Errorf("write_file_chunk: no connection")
+	}
+	u, err := c.sess.getUpload(p.UploadID)
+	if err != nil {
+		return nil, err
+	}
+	if p.Offset < 0 {
+		return nil, invalidParams("write_file_chunk: negative offset %d", p.Offset)
+	}
+	data, err := requestContent(ctx, p.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.tmp == nil {
+		return nil, newError(CodeNotFound, nil, "unknown upload %q (expired, committed, or started on another connection)", p.UploadID)
+	}
+	if _, err := u.tmp.WriteAt(data, p.Offset); err != nil {
+		return nil, fmt.Errorf("write temp: %w", err)
+	}
+	u.written += int64(len(data))
+	u.timer.Reset(uploadIdleTimeout)
+	return WriteFileChunkResult{Received: u.written}, nil
+}
+
+func (s *Server) handleWriteFileCommit(ctx context.Context, params json.RawMessage) (any, error) {
+	var p WriteFileCommitParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, invalidParams("unmarshal WriteFileCommitParams: %w", err)
+	}
+	c := callFromContext(ctx)
+	if c == nil {
+		return nil, fmt.Errorf("write_file_commit: no connection")
+	}
+	u := c.sess.takeUpload(p.UploadID)
+	if u == nil {
+		return nil, newError(CodeNotFound, nil, "unknown upload %q (expired, committed, or started on another connection)", p.UploadID)
+	}
+	u.timer.Stop()
+	// Commit owns the temp file from here on. A chunk that races in
+	// after this finds the upload gone; one already writing holds u.mu,
+	// so by the time we have the file no write is in flight.
+	u.mu.Lock()
+	tmp := u.tmp
+	u.tmp = nil
+	u.mu.Unlock()
+	if tmp == nil {
+		return nil, newError(CodeNotFound, nil, "unknown upload %q (expired, committed, or started on another connection)", p.UploadID)
+	}
+	defer tmp.Close()
+	// A no-op once the temp file has been renamed into place.
+	defer os.Remove(tmp.Name())
+
+	want := p.SHA256
+	if want == "" {
+		want = u.sha256
+	}
+	if want == "" {
+		return nil, invalidParams("write_file_commit: sha256 is required (at begin or commit)")
+	}
+
+	// Hash what actually landed on disk rather than trusting the chunks,
+	// which also catches a gap or overlap between them.
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("seek temp: %w", err)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, tmp); err != nil {
+		return nil, fmt.Errorf("read temp: %w", err)
+	}
+	newChecksum := hex.EncodeToString(h.Sum(nil))
+	if newChecksum != want {
+		return nil, newError(CodeConflict, &ErrorData{Path: u.params.Dest}, "write_file_commit: checksum mismatch for %s: got %s, want %s", u.params.Dest, newChecksum, want)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("close temp: %w", err)
+	}
+
+	s.Logger.Debug("upload committed", "upload", u.id, "dest", u.params.Dest)
+	return finishWrite(u.params, newChecksum, func(dir string) error {
+		if u.params.UnsafeWrites {
+			return copyFileContents(tmp.Name(), u.params.Dest)
+		}
+		if err := os.Rename(tmp.Name(), u.params.Dest); err != nil {
+			return fmt.Errorf("rename temp to %s: %w", u.params.Dest, err)
+		}
+		return nil
+	})
+}
+
+func (s *Server) handleWriteFileAbort(ctx context.Context, params json.RawMessage) (any, error) {
+	var p WriteFileAbortParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, invalidParams("unmarshal WriteFileAbortParams: %w", err)
+	}
+	c := callFromContext(ctx)
+	if c == nil {
+		return nil, fmt.Errorf("write_file_abort: no connection")
+	}
+	u := c.sess.takeUpload(p.UploadID)
+	if u != nil {
+		u.discard()
+	}
+	return WriteFileAbortResult{Aborted: u != nil}, nil
+}
+
+func (s *Server) handleReadFileChunk(ctx context.Context, params json.RawMessage) (any, error) {
+	var p ReadFileChunkParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, invalidParams("unmarshal ReadFileChunkParams: %w", err)
+	}
+	// See handleReadFile.
+	if p.BecomeUser != "" {
+		username := p.BecomeUser
+		p.BecomeUser = ""
+		return s.runAsUser(ctx, username, "ReadFileChunk", p)
+	}
+	if p.Offset < 0 {
+		return nil, invalidParams("read_file_chunk: negative offset %d", p.Offset)
+	}
+	length := p.Length
+	if length <= 0 {
+		length = defaultChunkSize
+	}
+	if length > maxChunkSize {
+		length = maxChunkSize
+	}
+
+	f, err := os.Open(p.Path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", p.Path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat %s: %w", p.Path, err)
+	}
+
+	buf := make([]byte, length)
+	n, err := f.ReadAt(buf, p.Offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("read %s: %w", p.Path, err)
+	}
+	return ReadFileChunkResult{
+		Content: responseContent(ctx, buf[:n]),
+		Offset:  p.Offset,
+		Size:    info.Size(),
+		EOF:     p.Offset+int64(n) >= info.Size(),
+	}, nil
+}
+
+// copyFileContents overwrites dst in place with src's content, keeping
+// dst's inode. That's what unsafe_writes asks for: bind-mounted files and
+// the like can't be replaced by rename.
+func copyFileContents(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("write %s: %w", dst, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("write %s: %w", dst, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("write %s: %w", dst, err)
+	}
+	return nil
+}
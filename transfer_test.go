@@ -0,0 +1,189 @@
+package fastagent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func decodeResult(t *testing.T, resp Response, v any) {
+	t.Helper()
+	if resp.Error != nil {
+		t.Fatalf("unexpected error: %v", resp.Error)
+	}
+	resultJSON, _ := json.Marshal(resp.Result)
+	if err := json.Unmarshal(resultJSON, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func rawParams(t *testing.T, v any) json.RawMessage {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestChunkedWriteFile(t *testing.T) {
+	s := newTestServer()
+	send, recv, stop := serveConn(t, s)
+	defer stop()
+
+	dest := filepath.Join(t.TempDir(), "sub", "big.bin")
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	sum := sha256.Sum256(content)
+
+	send(Request{ID: 1, Method: "WriteFileBegin", Params: rawParams(t, WriteFileBeginParams{
+		WriteFileParams: WriteFileParams{Dest: dest, Mode: "0640"},
+		SHA256:          hex.EncodeToString(sum[:]),
+	})})
+	var begin WriteFileBeginResult
+	decodeResult(t, recv(), &begin)
+
+	// Send the second half first: chunks are placed by offset.
+	half := len(content) / 2
+	for i, chunk := range []struct {
+		offset int
+		data   []byte
+	}{
+		{half, content[half:]},
+		{0, content[:half]},
+	} {
+		send(Request{ID: int64(2 + i), Method: "WriteFileChunk", Params: rawParams(t, WriteFileChunkParams{
+			UploadID: begin.UploadID,
+			Offset:   int64(chunk.offset),
+			Content:  base64.StdEncoding.EncodeToString(chunk.data),
+		})})
+		var res WriteFileChunkResult
+		decodeResult(t, recv(), &res)
+	}
+
+	send(Request{ID: 4, Method: "WriteFileCommit", Params: rawParams(t, WriteFileCommitParams{UploadID: begin.UploadID})})
+	var result WriteFileResult
+	decodeResult(t, recv(), &result)
+	if !result.Changed || result.Checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("commit result = %+v", result)
+	}
+
+	got, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("committed file does not match uploaded content")
+	}
+	info, err := os.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o640 {
+		t.Errorf("mode = %o, want 0640", info.Mode().Perm())
+	}
+	assertNoTempFiles(t, filepath.Dir(dest))
+}
+
+func TestChunkedWriteFileChecksumMismatch(t *testing.T) {
+	s := newTestServer()
+	send, recv, stop := serveConn(t, s)
+	defer stop()
+
+	dest := filepath.Join(t.TempDir(), "file")
+	send(Request{ID: 1, Method: "WriteFileBegin", Params: rawParams(t, WriteFileBeginParams{
+		WriteFileParams: WriteFileParams{Dest: dest},
+	})})
+	var begin WriteFileBeginResult
+	decodeResult(t, recv(), &begin)
+
+	send(Request{ID: 2, Method: "WriteFileChunk", Params: rawParams(t, WriteFileChunkParams{
+		UploadID: begin.UploadID,
+		Content:  base64.StdEncoding.EncodeToString([]byte("hello")),
+	})})
+	recv()
+
+	send(Request{ID: 3, Method: "WriteFileCommit", Params: rawParams(t, WriteFileCommitParams{
+		UploadID: begin.UploadID,
+		SHA256:   hex.EncodeToString(make([]byte, 32)),
+	})})
+	if resp := recv(); resp.Error == nil {
+		t.Fatal("expected checksum mismatch error")
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("dest exists after failed commit: %v", err)
+	}
+	assertNoTempFiles(t, filepath.Dir(dest))
+}
+
+// TestChunkedWriteFileAbandoned checks that an upload left unfinished when
+// the connection closes doesn't leave its temp file behind.
+func TestChunkedWriteFileAbandoned(t *testing.T) {
+	s := newTestServer()
+	send, recv, stop := serveConn(t, s)
+
+	dir := t.TempDir()
+	send(Request{ID: 1, Method: "WriteFileBegin", Params: rawParams(t, WriteFileBeginParams{
+		WriteFileParams: WriteFileParams{Dest: filepath.Join(dir, "file")},
+	})})
+	var begin WriteFileBeginResult
+	decodeResult(t, recv(), &begin)
+	send(Request{ID: 2, Method: "WriteFileChunk", Params: rawParams(t, WriteFileChunkParams{
+		UploadID: begin.UploadID,
+		Content:  base64.StdEncoding.EncodeToString([]byte("partial")),
+	})})
+	recv()
+	stop()
+
+	assertNoTempFiles(t, dir)
+}
+
+func assertNoTempFiles(t *testing.T, dir string) {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, ".fastagent-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) > 0 {
+		t.Errorf("temp files left behind: %v", matches)
+	}
+}
+
+func TestReadFileChunk(t *testing.T) {
+	s := newTestServer()
+
+	path := filepath.Join(t.TempDir(), "file")
+	content := []byte("hello, chunked world")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []byte
+	var offset int64
+	for {
+		var chunk ReadFileChunkResult
+		decodeResult(t, rpcCall(t, s, "ReadFileChunk", ReadFileChunkParams{Path: path, Offset: offset, Length: 8}), &chunk)
+		data, err := base64.StdEncoding.DecodeString(chunk.Content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunk.Size != int64(len(content)) {
+			t.Errorf("size = %d, want %d", chunk.Size, len(content))
+		}
+		got = append(got, data...)
+		offset += int64(len(data))
+		if chunk.EOF {
+			break
+		}
+		if len(data) == 0 {
+			t.Fatal("empty chunk before EOF")
+		}
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("reassembled %q, want %q", got, content)
+	}
+}